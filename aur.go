@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// overlays with this prefix are fetched from the AUR instead of the overlay directory
+const aur_prefix = "aur:"
+
+const default_aur_url = "https://aur.archlinux.org"
+
+// package as returned by the info and search requests of the AUR RPC interface
+type AurPackage struct {
+	Name         string   `json:"Name"`
+	PackageBase  string   `json:"PackageBase"`
+	Version      string   `json:"Version"`
+	Depends      []string `json:"Depends"`
+	MakeDepends  []string `json:"MakeDepends"`
+	CheckDepends []string `json:"CheckDepends"`
+	Provides     []string `json:"Provides"`
+}
+
+type aur_response struct {
+	Type    string       `json:"type"`
+	Error   string       `json:"error"`
+	Results []AurPackage `json:"results"`
+}
+
+// name of a dependency without version constraint, e.g. "foo>=1.2" becomes "foo"
+var dependency_name_regex = regexp.MustCompile(`^[^<>=]+`)
+
+// returns the package name of an overlay entry of the form aur:<name>
+func aur_name(overlay string) (string, bool) {
+	if !strings.HasPrefix(overlay, aur_prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(overlay, aur_prefix), true
+}
+
+// sends a request to the AUR RPC interface, path is relative to /rpc/v5/
+func aur_request(config Config, path string) ([]AurPackage, error) {
+	response, err := http.Get(strings.TrimRight(config.Aur_url, "/") + "/rpc/v5/" + path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the AUR: %w", err)
+	}
+	defer response.Body.Close()
+
+	var result aur_response
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse the AUR response: %w", err)
+	}
+	if result.Type == "error" {
+		return nil, fmt.Errorf("AUR request failed: %s", result.Error)
+	}
+	return result.Results, nil
+}
+
+// returns the AUR packages with the given names, names that aren't in the AUR are missing in the result
+func aur_info(config Config, names []string) (map[string]AurPackage, error) {
+	packages := map[string]AurPackage{}
+	if len(names) == 0 {
+		return packages, nil
+	}
+
+	query := url.Values{}
+	for _, name := range names {
+		query.Add("arg[]", name)
+	}
+	results, err := aur_request(config, "info?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range results {
+		packages[pkg.Name] = pkg
+	}
+	return packages, nil
+}
+
+// finds an AUR package that provides the dependency, e.g. foo-bin for foo
+func aur_provider(config Config, dependency string) (AurPackage, bool, error) {
+	results, err := aur_request(config, "search/"+url.PathEscape(dependency)+"?by=provides")
+	if err != nil || len(results) == 0 {
+		return AurPackage{}, false, err
+	}
+	// the search results don't contain the dependencies
+	info, err := aur_info(config, []string{results[0].Name})
+	pkg, ok := info[results[0].Name]
+	return pkg, ok, err
+}
+
+// checks whether a dependency is installed or can be installed from the repositories in pacman.conf
+func in_repositories(config Config, dependency string) bool {
+	if _, err := config.Runner.output("pacman -T " + dependency); err == nil {
+		return true
+	}
+	_, err := config.Runner.output("pacman --config " + config.Pacconfig + " -Sp --print-format %n " + dependency)
+	return err == nil
+}
+
+// resolves the AUR packages and their dependencies that are only available in the AUR.
+// The result is sorted so that dependencies come before the packages that need them
+func resolve_aur_packages(config Config, names []string) ([]AurPackage, error) {
+	var ordered []AurPackage
+	visited := map[string]bool{}
+
+	var visit func(pkg AurPackage) error
+	visit = func(pkg AurPackage) error {
+		if visited[pkg.PackageBase] {
+			return nil
+		}
+		visited[pkg.PackageBase] = true
+
+		var dependencies []string
+		for _, dependency := range append(append(pkg.Depends, pkg.MakeDepends...), pkg.CheckDepends...) {
+			dependencies = append(dependencies, dependency_name_regex.FindString(dependency))
+		}
+
+		// packages from the AUR are preferred so that they are rebuilt by nompac,
+		// everything else has to come from the repositories
+		found, err := aur_info(config, dependencies)
+		if err != nil {
+			return err
+		}
+		for _, dependency := range dependencies {
+			dependency_pkg, in_aur := found[dependency]
+			if !in_aur {
+				if in_repositories(config, dependency) {
+					continue
+				}
+				dependency_pkg, in_aur, err = aur_provider(config, dependency)
+				if err != nil {
+					return err
+				}
+				if !in_aur {
+					return fmt.Errorf("dependency %s of %s is neither in the repositories nor in the AUR", dependency, pkg.Name)
+				}
+			}
+			if err := visit(dependency_pkg); err != nil {
+				return err
+			}
+		}
+		ordered = append(ordered, pkg)
+		return nil
+	}
+
+	found, err := aur_info(config, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		pkg, ok := found[name]
+		if !ok {
+			return nil, fmt.Errorf("package %s not found in the AUR", name)
+		}
+		if err := visit(pkg); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// determines whether a package from the AUR has to be rebuilt.
+// The lock is keyed by pkgbase since all packages of a split PKGBUILD are built together
+func aur_package_state(configs Config, lock Lockfile, pkg AurPackage) PackageState {
+	state := PackageState{Name: pkg.PackageBase, Packages: lock.Packages[pkg.PackageBase].Packages, Version: pkg.Version}
+	state.Installed_version = configs.Manager.query_installed(installed_package_name(lock, pkg.PackageBase))
+
+	locked, built := lock.Packages[pkg.PackageBase]
+	switch {
+	case !built && state.Installed_version != state.Version:
+		state.Reasons = append(state.Reasons, "not built by nompac yet")
+	case !built:
+	case locked.Version != state.Version:
+		state.Reasons = append(state.Reasons, fmt.Sprintf("AUR version changed from %s to %s", locked.Version, state.Version))
+	}
+	state.Pending = len(state.Reasons) == 0 && state.Installed_version != state.Version
+	return state
+}
+
+// builds an AUR package declared as aur:<name> together with its dependencies from the AUR
+func build_aur_packages(configs Config, args Args, lock *Lockfile, name string) {
+	packages, err := resolve_aur_packages(configs, []string{name})
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return
+	}
+	for _, pkg := range packages {
+		required_by := ""
+		if pkg.Name != name {
+			required_by = name
+		}
+		if !build_aur_package(configs, args, lock, pkg, required_by) && required_by != "" {
+			fmt.Println(Red + "Skipping build of " + name + " since its dependency " + pkg.Name + " wasn't built." + Reset)
+			return
+		}
+	}
+}
+
+// builds a package from the AUR if its version changed since the last build and adds it to the local repository.
+// Dependencies (required_by is set) are installed afterwards so that the packages needing them can be built.
+// returns false if the package isn't available
+func build_aur_package(configs Config, args Args, lock *Lockfile, pkg AurPackage, required_by string) bool {
+	state := aur_package_state(configs, *lock, pkg)
+	state.Required_by = required_by
+
+	if len(state.Reasons) == 0 {
+		if _, built := lock.Packages[pkg.PackageBase]; !built {
+			lock_package(configs, lock, state)
+		}
+		fmt.Println(Green + "Package " + pkg.Name + " already up to date" + Reset)
+		return true
+	}
+	fmt.Printf("Building %s %s from the AUR: %s\n", pkg.Name, state.Version, strings.Join(state.Reasons, ", "))
+
+	// the snapshot contains the directory <pkgbase>
+	snapshot_url := fmt.Sprintf("%s/cgit/aur.git/snapshot/%s.tar.gz", strings.TrimRight(configs.Aur_url, "/"), url.PathEscape(pkg.PackageBase))
+	tarball, err := fetch_tarball(configs, lock, fmt.Sprintf("aur-%s-%s.tar.gz", pkg.PackageBase, pkg.Version), snapshot_url)
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return false
+	}
+	pkg_build_dir := prepare_work_dir(configs, pkg.PackageBase)
+	os.Remove(pkg_build_dir)
+	if err := extract_tgz(tarball, filepath.Dir(pkg_build_dir)); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return false
+	}
+
+	// PKGBUILDs from the AUR aren't trusted, every change has to be approved
+	snapshot_name := filepath.Join("aur", pkg.PackageBase)
+	if !review_aur_changes(configs, args, snapshot_name, pkg, pkg_build_dir) {
+		fmt.Println(Yellow + "Skipping build of " + pkg.Name + Reset)
+		finish_build(configs, pkg_build_dir, nil)
+		return false
+	}
+	stage_upstream_snapshot(configs, snapshot_name, pkg.Version, pkg_build_dir)
+
+	package_files, err := buildPackage(configs, pkg.Name, pkg_build_dir)
+	if err != nil {
+		fmt.Printf(Red+"Build of %s failed: %s\n"+Reset, pkg.Name, err)
+		finish_build(configs, pkg_build_dir, err)
+		return false
+	}
+	package_files = publish_packages(configs, pkg.Name, package_files)
+	if err := configs.Manager.add_to_local_repo(configs, package_files); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		finish_build(configs, pkg_build_dir, err)
+		return false
+	}
+	commit_upstream_snapshot(configs, snapshot_name)
+
+	if required_by != "" && len(package_files) > 0 {
+		configs.Manager.install_local(package_files, true)
+	}
+
+	state.Packages = package_names(package_files)
+	lock_package(configs, lock, state)
+	finish_build(configs, pkg_build_dir, nil)
+	evict_sources(configs)
+	return true
+}
+
+// shows the differences of the PKGBUILD and the other files of an AUR package to the last built version,
+// or all files if it wasn't built before. returns false if the changes weren't approved
+func review_aur_changes(config Config, args Args, snapshot_name string, pkg AurPackage, pkg_build_dir string) bool {
+	old_dir := upstream_snapshot_dir(config, snapshot_name)
+	old_version := "nothing"
+	if contents, err := os.ReadFile(old_dir + ".version"); err == nil {
+		old_version = strings.TrimSpace(string(contents))
+	} else {
+		// compare to an empty directory to show all files
+		old_dir, _ = os.MkdirTemp("", "nompac-aur")
+		defer os.RemoveAll(old_dir)
+	}
+
+	// diff exits with 1 if the directories differ and with 2 on errors
+	output, err := exec.Command("diff", "-ruN", "--exclude=.SRCINFO", old_dir, pkg_build_dir).Output()
+	if err == nil {
+		fmt.Println(Green + "No changes of " + pkg.Name + " in the AUR since the last build." + Reset)
+		return true
+	}
+	if exit_error, ok := err.(*exec.ExitError); !ok || exit_error.ExitCode() != 1 {
+		fmt.Printf(Red+"Couldn't compare the files of %s: %s\n"+Reset, pkg.Name, err)
+		return false
+	}
+
+	fmt.Printf(Blue+"\nChanges of %s in the AUR from %s to %s:\n"+Reset, pkg.Name, old_version, pkg.Version)
+	fmt.Println(string(output))
+	return ask_approval(args, fmt.Sprintf("Build %s %s from the AUR?", pkg.Name, pkg.Version))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var aur_test_packages = map[string]AurPackage{
+	"app":        {Name: "app", PackageBase: "app", Version: "1.0-1", Depends: []string{"libfoo>=1.0", "glibc"}, MakeDepends: []string{"aurdep"}},
+	"aurdep":     {Name: "aurdep", PackageBase: "aurdep", Version: "2.0-1"},
+	"libfoo-git": {Name: "libfoo-git", PackageBase: "libfoo-git", Version: "r10.abc-1", Depends: []string{"glibc"}, Provides: []string{"libfoo"}},
+	"foo":        {Name: "foo", PackageBase: "foo", Version: "3.0-1"},
+	"foo-cli":    {Name: "foo-cli", PackageBase: "foo", Version: "3.0-1", Depends: []string{"foo"}},
+	"broken":     {Name: "broken", PackageBase: "broken", Version: "1.0-1", Depends: []string{"nothing"}},
+}
+
+// serves the info and search requests of the AUR RPC interface for aur_test_packages
+func aur_test_server(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		response := aur_response{Type: "multiinfo", Results: []AurPackage{}}
+		switch {
+		case request.URL.Path == "/rpc/v5/info":
+			for _, name := range request.URL.Query()["arg[]"] {
+				if pkg, ok := aur_test_packages[name]; ok {
+					response.Results = append(response.Results, pkg)
+				}
+			}
+		case strings.HasPrefix(request.URL.Path, "/rpc/v5/search/") && request.URL.Query().Get("by") == "provides":
+			response.Type = "search"
+			dependency := strings.TrimPrefix(request.URL.Path, "/rpc/v5/search/")
+			for _, name := range sorted_keys(aur_test_packages) {
+				if contains(aur_test_packages[name].Provides, dependency) {
+					// the search results don't contain the dependencies
+					response.Results = append(response.Results, AurPackage{Name: name, PackageBase: aur_test_packages[name].PackageBase})
+				}
+			}
+		default:
+			response = aur_response{Type: "error", Error: "Incorrect request type specified."}
+		}
+		json.NewEncoder(writer).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAurInfo(t *testing.T) {
+	config := Config{Aur_url: aur_test_server(t).URL}
+
+	packages, err := aur_info(config, []string{"foo", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AurPackage{"foo": aur_test_packages["foo"]}; !reflect.DeepEqual(packages, want) {
+		t.Errorf("aur_info() = %v, want %v", packages, want)
+	}
+}
+
+func TestAurProvider(t *testing.T) {
+	config := Config{Aur_url: aur_test_server(t).URL}
+
+	pkg, found, err := aur_provider(config, "libfoo")
+	if err != nil || !found {
+		t.Fatalf("aur_provider() didn't find libfoo: %v", err)
+	}
+	if !reflect.DeepEqual(pkg, aur_test_packages["libfoo-git"]) {
+		t.Errorf("aur_provider() = %v, want the info of libfoo-git", pkg)
+	}
+
+	if _, found, err := aur_provider(config, "nothing"); found || err != nil {
+		t.Errorf("aur_provider() found a provider of nothing: %v", err)
+	}
+}
+
+func TestResolveAurPackages(t *testing.T) {
+	server := aur_test_server(t)
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+		err   bool
+	}{
+		{"dependencies first", []string{"app"}, []string{"libfoo-git", "aurdep", "app"}, false},
+		{"split package is resolved once", []string{"foo-cli", "foo"}, []string{"foo-cli"}, false},
+		{"dependency isn't available", []string{"broken"}, nil, true},
+		{"not in the AUR", []string{"unknown"}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// glibc is in the repositories
+			runner := &recording_runner{outputs: map[string]string{"pacman -T glibc": ""}}
+			config := Config{Aur_url: server.URL, Pacconfig: "/etc/pacman.conf", Runner: runner}
+
+			packages, err := resolve_aur_packages(config, test.names)
+			if (err != nil) != test.err {
+				t.Fatalf("resolve_aur_packages() error = %v", err)
+			}
+			var names []string
+			for _, pkg := range packages {
+				names = append(names, pkg.Name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("resolve_aur_packages() = %q, want %q", names, test.want)
+			}
+		})
+	}
+}
+
+func TestAurPackageStateSplitPackage(t *testing.T) {
+	runner := &recording_runner{outputs: map[string]string{"pacman -Q foo": "foo 3.0-1\n"}}
+	config := Config{Manager: &pacman_manager{runner: runner}}
+	lock := Lockfile{Packages: map[string]LockedPackage{"foo": {Version: "3.0-1", Packages: []string{"foo", "foo-cli"}}}}
+
+	// foo-cli was built together with foo
+	state := aur_package_state(config, lock, aur_test_packages["foo-cli"])
+	if state.Name != "foo" || len(state.Reasons) > 0 {
+		t.Errorf("aur_package_state() = %s with reasons %q, want the up to date pkgbase foo", state.Name, state.Reasons)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// state of a package that nompac builds into the local repository
+type PackageState struct {
+	Name string
+	// version in the official repositories or in the PKGBUILD of an overlay, the local release is appended to it
+	Upstream_version  string
+	Installed_version string
+	// version nompac builds
+	Version       string
+	Input_hash    string
+	Local_release int
+	Patches       []PatchSpec
+	// reasons why the package has to be rebuilt, empty if it is up to date
+	Reasons []string
+	// the package was built but isn't installed yet
+	Pending bool
+	// names of the packages published in the local repository, more than one for split packages
+	Packages []string
+	// AUR package that pulled in this package as dependency
+	Required_by string
+	// archive date and repository of a package that was cherry-picked from a newer snapshot
+	Snapshot   string
+	Repository string
+}
+
+// determines the version a package from the official repositories is built with and whether it has to be rebuilt
+func upstream_package_state(configs Config, lock Lockfile, pkg string, patches []PatchSpec) (PackageState, error) {
+	state := PackageState{Name: pkg, Packages: lock.Packages[pkg].Packages}
+	state.Upstream_version = get_current_version_from_repo(pkg)
+	state.Installed_version = configs.Manager.query_installed(installed_package_name(lock, pkg))
+
+	// only use the patches that apply to the upstream version in the configured order
+	patches, err := select_patches(pkg, state.Upstream_version, patches)
+	if err != nil {
+		return state, err
+	}
+	if _, has_override := configs.Overrides[pkg]; len(patches) == 0 && !has_override {
+		return state, fmt.Errorf("No patches of %s apply to version %s.", pkg, state.Upstream_version)
+	}
+	state.Patches = patches
+
+	// the local release is bumped whenever the patches change while the upstream version stays the same
+	state.Input_hash = upstream_input_hash(configs, pkg, patches)
+	locked, built := lock.Packages[pkg]
+	state.Local_release = 1
+	if locked.Upstream_version == state.Upstream_version {
+		state.Local_release = locked.Local_release
+		if locked.Input_hash != state.Input_hash {
+			state.Local_release++
+		}
+	}
+	state.Version = local_version(configs, state.Upstream_version, state.Local_release)
+
+	switch {
+	case !built && state.Installed_version != state.Version:
+		state.Reasons = append(state.Reasons, "not built by nompac yet")
+	case !built:
+	default:
+		if locked.Upstream_version != state.Upstream_version {
+			state.Reasons = append(state.Reasons, fmt.Sprintf("upstream version changed from %s to %s", locked.Upstream_version, state.Upstream_version))
+		}
+		if locked.Input_hash != state.Input_hash {
+			state.Reasons = append(state.Reasons, "patches or overrides changed")
+		}
+	}
+	state.Pending = len(state.Reasons) == 0 && state.Installed_version != state.Version
+	return state, nil
+}
+
+// determines whether a package from an overlay has to be rebuilt
+func overlay_package_state(configs Config, lock Lockfile, pkg string) PackageState {
+	state := PackageState{Name: pkg, Packages: lock.Packages[pkg].Packages}
+	state.Upstream_version = strings.TrimSpace(get_version_from_overlay(configs, pkg))
+	state.Installed_version = configs.Manager.query_installed(installed_package_name(lock, pkg))
+	state.Input_hash = overlay_input_hash(configs, pkg)
+
+	// the local release is bumped whenever the overlay files change while the version in the PKGBUILD stays the same,
+	// otherwise pacman wouldn't install the rebuild
+	locked, built := lock.Packages[pkg]
+	overlay_version := locked.Upstream_version
+	if overlay_version == "" {
+		// lockfiles of older versions only contain the built version
+		overlay_version = locked.Version
+	}
+	if built && overlay_version == state.Upstream_version {
+		state.Local_release = locked.Local_release
+		if locked.Input_hash != state.Input_hash {
+			state.Local_release++
+		}
+	}
+	state.Version = state.Upstream_version
+	if state.Local_release > 0 {
+		state.Version = local_version(configs, state.Upstream_version, state.Local_release)
+	}
+
+	switch {
+	case !built && state.Installed_version != state.Version:
+		state.Reasons = append(state.Reasons, "not built by nompac yet")
+	case !built:
+	default:
+		if overlay_version != state.Upstream_version {
+			state.Reasons = append(state.Reasons, fmt.Sprintf("overlay version changed from %s to %s", overlay_version, state.Upstream_version))
+		}
+		if locked.Input_hash != state.Input_hash {
+			state.Reasons = append(state.Reasons, "overlay files changed")
+		}
+	}
+	state.Pending = len(state.Reasons) == 0 && state.Installed_version != state.Version
+	return state
+}
+
+// records the state of a package in the lockfile
+func lock_package(configs Config, lock *Lockfile, state PackageState) {
+	lock.Packages[state.Name] = LockedPackage{
+		Upstream_version: state.Upstream_version,
+		Input_hash:       state.Input_hash,
+		Local_release:    state.Local_release,
+		Version:          state.Version,
+		Packages:         state.Packages,
+		Required_by:      state.Required_by,
+		Snapshot:         state.Snapshot,
+		Repository:       state.Repository,
+	}
+	if err := write_lockfile(configs, *lock); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+	}
+}
+
+// builds a package from the official repositories with its patches and overrides if the upstream version
+// or the patches changed since the last build and adds it to the local repository
+func build_upstream_package(configs Config, args Args, lock *Lockfile, pkg string, patches []PatchSpec) {
+	state, err := upstream_package_state(configs, *lock, pkg, patches)
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return
+	}
+
+	//only procede if the package was updated upstream or the patches changed
+	if len(state.Reasons) == 0 {
+		if _, built := lock.Packages[pkg]; !built {
+			// installed before nompac kept a lockfile
+			lock_package(configs, lock, state)
+		}
+		fmt.Println(Green + fmt.Sprintf("Package %s already up to date."+Reset, pkg))
+		return
+	}
+	fmt.Printf("Building %s %s: %s\n", pkg, state.Version, strings.Join(state.Reasons, ", "))
+
+	package_version_repo := state.Upstream_version
+	pkg_build_dir, err := prepare_upstream_work_dir(configs, lock, pkg, package_version_repo)
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return
+	}
+
+	// show what changed upstream since the last build before the patches are added
+	if !review_upstream_changes(configs, args, pkg, package_version_repo, pkg_build_dir) {
+		fmt.Println(Yellow + "Skipping build of " + pkg + Reset)
+		finish_build(configs, pkg_build_dir, nil)
+		return
+	}
+	stage_upstream_snapshot(configs, pkg, package_version_repo, pkg_build_dir)
+
+	// find patches that no longer apply before starting the full build
+	if !check_patches(configs, pkg, pkg_build_dir, state.Patches) {
+		fmt.Println(Red + "Skipping build of " + pkg + " since not all patches apply." + Reset)
+		finish_build(configs, pkg_build_dir, fmt.Errorf("not all patches of %s apply", pkg))
+		return
+	}
+
+	applyPatches(configs, state.Patches, pkg, pkg_build_dir)
+
+	if err := apply_overrides(configs, pkg, pkg_build_dir); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		finish_build(configs, pkg_build_dir, err)
+		return
+	}
+
+	if err := set_pkgrel(pkg_build_dir, state.Version); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		finish_build(configs, pkg_build_dir, err)
+		return
+	}
+
+	package_files, err := buildPackage(configs, pkg, pkg_build_dir)
+	if err != nil {
+		fmt.Printf(Red+"Build of %s failed: %s\n"+Reset, pkg, err)
+		finish_build(configs, pkg_build_dir, err)
+		return
+	}
+
+	package_files = publish_packages(configs, pkg, package_files)
+	if err := configs.Manager.add_to_local_repo(configs, package_files); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		finish_build(configs, pkg_build_dir, err)
+		return
+	}
+	commit_upstream_snapshot(configs, pkg)
+	state.Packages = package_names(package_files)
+	lock_package(configs, lock, state)
+	finish_build(configs, pkg_build_dir, nil)
+	evict_sources(configs)
+}
+
+// builds a package from the overlay directory if its version or files changed since the last build
+func build_overlay_package(configs Config, lock *Lockfile, pkg string) {
+	state := overlay_package_state(configs, *lock, pkg)
+
+	if len(state.Reasons) == 0 {
+		if _, built := lock.Packages[pkg]; !built {
+			lock_package(configs, lock, state)
+		}
+		fmt.Println(Green + "Package " + pkg + " already up to date" + Reset)
+		return
+	}
+	fmt.Printf("Building %s %s: %s\n", pkg, state.Version, strings.Join(state.Reasons, ", "))
+
+	// copy necessary files from overlay to build directory
+	pkg_build_dir := prepare_work_dir(configs, pkg)
+	filepath.WalkDir(filepath.Join(configs.Overlay_dir, pkg), func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// if entry is a file,continue
+		if !entry.IsDir() {
+			copyFile(path, filepath.Join(pkg_build_dir, entry.Name()))
+		}
+		return nil
+	})
+
+	if state.Version != state.Upstream_version {
+		if err := set_pkgrel(pkg_build_dir, state.Version); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			finish_build(configs, pkg_build_dir, err)
+			return
+		}
+	}
+
+	// build the package
+	package_files, err := buildPackage(configs, pkg, pkg_build_dir)
+	if err != nil {
+		fmt.Printf(Red+"Build of %s failed: %s\n"+Reset, pkg, err)
+		finish_build(configs, pkg_build_dir, err)
+		return
+	}
+	package_files = publish_packages(configs, pkg, package_files)
+	if err := configs.Manager.add_to_local_repo(configs, package_files); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		finish_build(configs, pkg_build_dir, err)
+		return
+	}
+	state.Packages = package_names(package_files)
+	lock_package(configs, lock, state)
+	finish_build(configs, pkg_build_dir, nil)
+	evict_sources(configs)
+}
+
+// handles "nompac status": shows which packages of the local repository are stale and why
+func status_command(configs Config) {
+	lock := read_lockfile(configs)
+
+	print_state := func(state PackageState) {
+		switch {
+		case len(state.Reasons) > 0:
+			fmt.Printf(Yellow+"  %s: stale (%s)\n"+Reset, state.Name, strings.Join(state.Reasons, ", "))
+		case state.Pending:
+			fmt.Printf(Blue+"  %s: %s built, installed %s\n"+Reset, state.Name, state.Version, installed_or_none(state.Installed_version))
+		default:
+			fmt.Printf(Green+"  %s: up to date (%s)\n"+Reset, state.Name, state.Version)
+		}
+	}
+
+	fmt.Println(Blue + "Patched upstream-packages:" + Reset)
+	for _, pkg := range sorted_keys(upstream_packages(configs)) {
+		state, err := upstream_package_state(configs, lock, pkg, upstream_packages(configs)[pkg])
+		if err != nil {
+			fmt.Println(Red + "  " + pkg + ": " + err.Error() + Reset)
+			continue
+		}
+		print_state(state)
+	}
+
+	fmt.Println(Blue + "Packages from overlays:" + Reset)
+	for _, pkg := range configs.Overlays {
+		name, is_aur := aur_name(pkg)
+		if !is_aur {
+			print_state(overlay_package_state(configs, lock, pkg))
+			continue
+		}
+		packages, err := resolve_aur_packages(configs, []string{name})
+		if err != nil {
+			fmt.Println(Red + "  " + name + ": " + err.Error() + Reset)
+			continue
+		}
+		for _, aur_pkg := range packages {
+			print_state(aur_package_state(configs, lock, aur_pkg))
+		}
+	}
+
+	if len(configs.Package_snapshots) > 0 {
+		fmt.Println(Blue + "Cherry-picked packages:" + Reset)
+		for _, pkg := range sorted_keys(configs.Package_snapshots) {
+			print_state(cherry_pick_state(configs, lock, pkg, configs.Package_snapshots[pkg]))
+		}
+		for _, pkg := range sorted_keys(lock.Packages) {
+			if locked := lock.Packages[pkg]; locked.Snapshot != "" && locked.Required_by != "" {
+				print_state(cherry_pick_state(configs, lock, pkg, locked.Snapshot))
+			}
+		}
+	}
+}
+
+// returns the name of the package whose installed version is compared to the built version.
+// The pkgbase of a split package doesn't have to be a package itself, then the first published package is used
+func installed_package_name(lock Lockfile, pkg string) string {
+	packages := lock.Packages[pkg].Packages
+	if len(packages) == 0 || contains(packages, pkg) {
+		return pkg
+	}
+	return packages[0]
+}
+
+// returns the package names of package files
+func package_names(package_files []string) []string {
+	var names []string
+	for _, package_file := range package_files {
+		if match := package_file_regex.FindStringSubmatch(filepath.Base(package_file)); match != nil {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+func installed_or_none(version string) string {
+	if version == "" {
+		return "none"
+	}
+	return version
+}
+
+// appends the local release to the pkgrel of the upstream version, e.g. 0.17.4-2 becomes 0.17.4-2.1.
+// makepkg only accepts pkgrel in the form integer[.integer], so the local release is a number
+// that can be prefixed with the digits of local_suffix
+func local_version(config Config, upstream_version string, local_release int) string {
+	if config.Local_suffix == "none" {
+		return upstream_version
+	}
+	if strings.Contains(upstream_version[strings.LastIndex(upstream_version, "-")+1:], ".") {
+		fmt.Println(Yellow + "pkgrel of " + upstream_version + " already contains a dot, no local release is added." + Reset)
+		return upstream_version
+	}
+	return upstream_version + "." + config.Local_suffix + strconv.Itoa(local_release)
+}
+
+// sets pkgrel in the PKGBUILD to the release of version
+func set_pkgrel(pkg_build_dir string, version string) error {
+	file := filepath.Join(pkg_build_dir, "PKGBUILD")
+	pkgbuild, err := read_pkgbuild(file)
+	if err != nil {
+		return fmt.Errorf("couldn't read PKGBUILD in %s: %w", pkg_build_dir, err)
+	}
+
+	_, _, pkgrel := parse_evr(version)
+	if pkgbuild.value("pkgrel") == pkgrel {
+		return nil
+	}
+	pkgbuild.set_variable("pkgrel", pkgrel)
+
+	if err := pkgbuild.write(file); err != nil {
+		return fmt.Errorf("couldn't write PKGBUILD in %s: %w", pkg_build_dir, err)
+	}
+	return nil
+}
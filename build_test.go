@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOverlayPackageState(t *testing.T) {
+	overlay_dir := t.TempDir()
+	os.MkdirAll(filepath.Join(overlay_dir, "foo-dkms"), os.FileMode(0755))
+	os.WriteFile(filepath.Join(overlay_dir, "foo-dkms", "PKGBUILD"), []byte("pkgname=foo-dkms\npkgver=1.0\npkgrel=1\n"), 0644)
+	os.WriteFile(filepath.Join(overlay_dir, "foo-dkms", "dkms.conf"), []byte("PACKAGE_NAME=foo\n"), 0644)
+	config := Config{Overlay_dir: overlay_dir}
+	input_hash := overlay_input_hash(config, "foo-dkms")
+
+	tests := []struct {
+		name          string
+		locked        *LockedPackage
+		installed     string
+		local_release int
+		version       string
+		reasons       []string
+	}{
+		{
+			name:    "not built yet",
+			version: "1.0-1",
+			reasons: []string{"not built by nompac yet"},
+		},
+		{
+			name:      "up to date",
+			locked:    &LockedPackage{Upstream_version: "1.0-1", Input_hash: input_hash, Version: "1.0-1"},
+			installed: "1.0-1",
+			version:   "1.0-1",
+		},
+		{
+			name:          "files changed",
+			locked:        &LockedPackage{Upstream_version: "1.0-1", Input_hash: "old", Version: "1.0-1"},
+			installed:     "1.0-1",
+			local_release: 1,
+			version:       "1.0-1.1",
+			reasons:       []string{"overlay files changed"},
+		},
+		{
+			name:          "files changed again",
+			locked:        &LockedPackage{Upstream_version: "1.0-1", Input_hash: "old", Local_release: 1, Version: "1.0-1.1"},
+			installed:     "1.0-1.1",
+			local_release: 2,
+			version:       "1.0-1.2",
+			reasons:       []string{"overlay files changed"},
+		},
+		{
+			name:          "local release is kept",
+			locked:        &LockedPackage{Upstream_version: "1.0-1", Input_hash: input_hash, Local_release: 2, Version: "1.0-1.2"},
+			installed:     "1.0-1.2",
+			local_release: 2,
+			version:       "1.0-1.2",
+		},
+		{
+			name:      "new version resets the local release",
+			locked:    &LockedPackage{Upstream_version: "0.9-1", Input_hash: "old", Local_release: 2, Version: "0.9-1.2"},
+			installed: "0.9-1.2",
+			version:   "1.0-1",
+			reasons:   []string{"overlay version changed from 0.9-1 to 1.0-1", "overlay files changed"},
+		},
+		{
+			name:          "lockfile without overlay version",
+			locked:        &LockedPackage{Input_hash: "old", Version: "1.0-1"},
+			installed:     "1.0-1",
+			local_release: 1,
+			version:       "1.0-1.1",
+			reasons:       []string{"overlay files changed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &recording_runner{outputs: map[string]string{}}
+			if test.installed != "" {
+				runner.outputs["pacman -Q foo-dkms"] = "foo-dkms " + test.installed + "\n"
+			}
+			config.Manager = &pacman_manager{runner: runner}
+			lock := Lockfile{Packages: map[string]LockedPackage{}}
+			if test.locked != nil {
+				lock.Packages["foo-dkms"] = *test.locked
+			}
+
+			state := overlay_package_state(config, lock, "foo-dkms")
+			if state.Local_release != test.local_release || state.Version != test.version {
+				t.Errorf("local release %d and version %s, want %d and %s", state.Local_release, state.Version, test.local_release, test.version)
+			}
+			if !reflect.DeepEqual(state.Reasons, test.reasons) {
+				t.Errorf("reasons = %q, want %q", state.Reasons, test.reasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Layout of the build directory:
+//   sources/  shared source cache, downloaded sources are stored by their sha256 checksum in sources/sha256
+//             next to the verified upstream tarballs
+//   srcdest/  SRCDEST of makepkg per package, the cached sources are linked into it by their file names
+//   work/     one working directory per build, removed after a successful build and kept after a failure
+//   pkgdest/  packages created by makepkg until they are added to the local repository
+
+// marker file in a working directory whose build failed
+const failed_marker = ".nompac-failed"
+
+func sources_dir(config Config) string {
+	return filepath.Join(config.Build_dir, "sources")
+}
+
+func srcdest_dir(config Config, packagename string) string {
+	return filepath.Join(config.Build_dir, "srcdest", packagename)
+}
+
+func work_dir(config Config, name string) string {
+	return filepath.Join(config.Build_dir, "work", name)
+}
+
+func pkgdest_dir(config Config, name string) string {
+	return filepath.Join(config.Build_dir, "pkgdest", name)
+}
+
+// creates an empty working directory for a build
+func prepare_work_dir(config Config, name string) string {
+	dir := work_dir(config, name)
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, os.FileMode(0777))
+	os.MkdirAll(sources_dir(config), os.FileMode(0777))
+	return dir
+}
+
+// downloads the packaging files of an upstream package to the source cache and extracts them into
+// a new working directory. returns the working directory containing the PKGBUILD
+func prepare_upstream_work_dir(config Config, lock *Lockfile, packagename string, packageversion string) (string, error) {
+	name := fmt.Sprintf("%s-%s", packagename, packageversion)
+	os.MkdirAll(sources_dir(config), os.FileMode(0777))
+
+	tarball, err := fetch_upstream_tarball(config, lock, packagename, packageversion)
+	if err != nil {
+		return "", err
+	}
+
+	// the tarball contains the directory <pkgname>-<version>
+	dir := prepare_work_dir(config, name)
+	os.Remove(dir)
+	if err := extract_tgz(tarball, filepath.Dir(dir)); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// returns the path of the verified tarball of an upstream package in the source cache
+func fetch_upstream_tarball(config Config, lock *Lockfile, packagename string, packageversion string) (string, error) {
+	return fetch_tarball(config, lock, fmt.Sprintf("%s-%s.tar.gz", packagename, packageversion), upstream_tarball_url(packagename, packageversion))
+}
+
+// returns the path of the tarball name in the source cache.
+// A cached tarball is used if it matches the hash in the lockfile, otherwise it is downloaded from url again.
+// The hash of the first download is recorded, later downloads with different contents are refused
+func fetch_tarball(config Config, lock *Lockfile, name string, url string) (string, error) {
+	tarball := filepath.Join(sources_dir(config), name)
+	recorded, known := lock.Tarballs[name]
+
+	if hash, err := archive_hash(tarball); err == nil && (!known || hash == recorded) {
+		fmt.Println("Using cached " + name)
+		if !known {
+			record_tarball(config, lock, name, hash)
+		}
+		return tarball, nil
+	}
+
+	if err := download_tarball(url, tarball); err != nil {
+		return "", err
+	}
+	hash, err := archive_hash(tarball)
+	if err != nil {
+		return "", fmt.Errorf("%s is damaged: %w", name, err)
+	}
+	if known && hash != recorded {
+		os.Remove(tarball)
+		return "", fmt.Errorf("contents of %s don't match the hash recorded in %s, refusing to build it", name, lockfile_path(config))
+	}
+	if !known {
+		record_tarball(config, lock, name, hash)
+	}
+	return tarball, nil
+}
+
+func record_tarball(config Config, lock *Lockfile, name string, hash string) {
+	lock.Tarballs[name] = hash
+	if err := write_lockfile(config, *lock); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+	}
+}
+
+// returns the SRCDEST of a package for makepkg. It keeps the links to the cached sources between builds,
+// so sources of different packages with the same file name don't collide
+func prepare_srcdest(config Config, packagename string) string {
+	dir := srcdest_dir(config, packagename)
+	os.MkdirAll(dir, os.FileMode(0777))
+	return dir
+}
+
+// moves the sources that makepkg downloaded to SRCDEST into the source cache and links them by name.
+// Links to the cache and VCS checkouts (directories) are skipped
+func store_sources(config Config, srcdest string) {
+	entries, _ := os.ReadDir(srcdest)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := cache_source(config, filepath.Join(srcdest, entry.Name())); err != nil {
+			fmt.Println(Yellow + "Couldn't add " + entry.Name() + " to the source cache: " + err.Error() + Reset)
+		}
+	}
+}
+
+// moves a file into the source cache and replaces it with a link to the cached file.
+// Files with the same contents are only stored once
+func cache_source(config Config, file string) error {
+	checksum, err := file_sha256(file)
+	if err != nil {
+		return err
+	}
+	// the link has to point to the cache from the directory of the file
+	cached, err := filepath.Abs(filepath.Join(sources_dir(config), "sha256", checksum))
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(cached), os.FileMode(0777))
+	if _, err := os.Stat(cached); err == nil {
+		err = os.Remove(file)
+	} else {
+		err = os.Rename(file, cached)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Symlink(cached, file)
+}
+
+func file_sha256(file string) (string, error) {
+	contents, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer contents.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, contents); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// removes the working directory and the package output of a successful build.
+// After a failure, the working directory is kept for debugging and marked as failed
+func finish_build(config Config, dir string, build_err error) {
+	if build_err != nil {
+		message := fmt.Sprintf("%s\n%s\n", time.Now().Format(time.RFC3339), build_err)
+		os.WriteFile(filepath.Join(dir, failed_marker), []byte(message), 0644)
+		fmt.Println(Yellow + "Keeping " + dir + " for debugging. Remove it with nompac clean -failed" + Reset)
+		return
+	}
+	os.RemoveAll(dir)
+	os.RemoveAll(pkgdest_dir(config, filepath.Base(dir)))
+}
+
+// handles "nompac clean": without flags, working directories of successful or interrupted builds are removed
+func clean_command(config Config, command []string) {
+	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	all := flags.Bool("all", false, "Remove the whole build directory including failed builds and the source cache.")
+	failed := flags.Bool("failed", false, "Remove the working directories of failed builds.")
+	sources := flags.Bool("sources", false, "Remove the source cache.")
+	flags.Parse(command)
+
+	if *all {
+		for _, dir := range []string{"work", "pkgdest", "srcdest", "sources"} {
+			remove_dir(filepath.Join(config.Build_dir, dir))
+		}
+		return
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(config.Build_dir, "work"))
+	for _, entry := range entries {
+		dir := work_dir(config, entry.Name())
+		_, err := os.Stat(filepath.Join(dir, failed_marker))
+		if is_failed := err == nil; is_failed == *failed {
+			remove_dir(dir)
+		}
+	}
+	if !*failed {
+		remove_dir(filepath.Join(config.Build_dir, "pkgdest"))
+	}
+
+	if *sources {
+		remove_dir(filepath.Join(config.Build_dir, "srcdest"))
+		remove_dir(sources_dir(config))
+	} else {
+		evict_sources(config)
+	}
+}
+
+func remove_dir(dir string) {
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	fmt.Println("Removing " + dir)
+	if err := os.RemoveAll(dir); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+	}
+}
+
+// removes the least recently used files from the source cache until it is smaller than source_cache_size
+func evict_sources(config Config) {
+	if config.Source_cache_size <= 0 {
+		return
+	}
+	limit := int64(config.Source_cache_size) * 1024 * 1024
+
+	type cached_file struct {
+		path      string
+		size      int64
+		last_used time.Time
+	}
+	var files []cached_file
+	var total int64
+
+	filepath.WalkDir(sources_dir(config), func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, cached_file{path: path, size: info.Size(), last_used: last_used(info)})
+		total += info.Size()
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].last_used.Before(files[j].last_used)
+	})
+
+	for _, file := range files {
+		if total <= limit {
+			break
+		}
+		fmt.Println("Evicting " + filepath.Base(file.path) + " from the source cache")
+		if err := os.Remove(file.path); err == nil {
+			total -= file.size
+		}
+	}
+	remove_dangling_links(filepath.Join(config.Build_dir, "srcdest"))
+}
+
+// removes the links to evicted sources so that makepkg downloads them again
+func remove_dangling_links(dir string) {
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.Type()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if _, err := os.Stat(path); err != nil {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// returns the time a file was last read or written. makepkg only reads cached sources, so the access time is used
+func last_used(info os.FileInfo) time.Time {
+	used := info.ModTime()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if accessed := time.Unix(stat.Atim.Sec, stat.Atim.Nsec); accessed.After(used) {
+			used = accessed
+		}
+	}
+	return used
+}
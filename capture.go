@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// config written by nompac capture, only contains the settings that are read from the system
+type captured_config struct {
+	Name          string              `json:"name"`
+	Packagegroups string              `json:"packagegroups"`
+	Pacconfig     string              `json:"pacconfig"`
+	Mirrorlist    string              `json:"mirrorlist"`
+	Snapshot      string              `json:"snapshot,omitempty"`
+	Packages      []Packages          `json:"packages"`
+	Overlays      []string            `json:"overlays,omitempty"`
+	Services      map[string][]string `json:"services,omitempty"`
+}
+
+// matches the archive server that set_snapshot writes to the mirrorlist
+var snapshot_server_regex = regexp.MustCompile(`(?m)^\s*Server\s*=\s*https://archive\.archlinux\.org/repos/(\d{4})/(\d{2})/(\d{2})/`)
+
+// handles "nompac capture", which writes a config of the current system for onboarding a new machine.
+// It runs without a config file
+func capture_command(command []string) {
+	flags := flag.NewFlagSet("capture", flag.ExitOnError)
+	dir := flags.String("dir", "", "Directory the config.json, pacman.conf and mirrorlist are written to. Without it, the config is printed.")
+	group_by := flags.String("group-by", "group", "Grouping of the packages: group (pacman groups like plasma, then repository), repo or none (everything in unsorted).")
+	pacconfig := flags.String("pacconfig", "/etc/pacman.conf", "pacman.conf of the system")
+	mirrorlist := flags.String("mirrorlist", "/etc/pacman.d/mirrorlist", "mirrorlist of the system")
+	flags.Parse(command)
+
+	if *group_by != "group" && *group_by != "repo" && *group_by != "none" {
+		fmt.Println(Red + "Unknown grouping " + *group_by + ", use group, repo or none." + Reset)
+		os.Exit(2)
+	}
+
+	explicit, err := pacman_list("-Qqe")
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		os.Exit(1)
+	}
+	foreign, err := pacman_list("-Qqm")
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		os.Exit(1)
+	}
+
+	repositories := map[string]string{}
+	if *group_by != "none" {
+		repositories = package_repositories()
+	}
+	package_groups := map[string][]string{}
+	if *group_by == "group" {
+		package_groups = installed_package_groups()
+	}
+
+	hostname, _ := os.Hostname()
+	captured := captured_config{
+		Name:          "Captured from " + hostname,
+		Packagegroups: "all",
+		Pacconfig:     *pacconfig,
+		Mirrorlist:    *mirrorlist,
+		Packages:      []Packages{group_packages(explicit, foreign, repositories, package_groups, *group_by)},
+		Overlays:      overlay_candidates(explicit, foreign),
+	}
+	if services := enabled_units("/etc/systemd/system"); len(services) > 0 {
+		captured.Services = map[string][]string{"system": services}
+	}
+	if mirrors, err := os.ReadFile(*mirrorlist); err == nil {
+		if date := snapshot_server_regex.FindSubmatch(mirrors); date != nil {
+			captured.Snapshot = fmt.Sprintf("%s_%s_%s", date[1], date[2], date[3])
+		}
+	}
+
+	if *dir == "" {
+		output, _ := json.MarshalIndent(captured, "", "  ")
+		fmt.Println(string(output))
+		return
+	}
+
+	*dir = resolve_home(*dir)
+	config_file := filepath.Join(*dir, "config.json")
+	if _, err := os.Stat(config_file); err == nil {
+		fmt.Println(Red + config_file + " already exists, choose another directory." + Reset)
+		os.Exit(1)
+	}
+	os.MkdirAll(*dir, os.FileMode(0755))
+
+	// the config uses copies of pacman.conf and the mirrorlist that nompac modifies
+	captured.Pacconfig = filepath.Join(*dir, "pacman.conf")
+	captured.Mirrorlist = filepath.Join(*dir, "mirrorlist")
+	if err := copyFile(*pacconfig, captured.Pacconfig); err != nil {
+		fmt.Println(Red + "Couldn't copy " + *pacconfig + ": " + err.Error() + Reset)
+	}
+	if err := copyFile(*mirrorlist, captured.Mirrorlist); err != nil {
+		fmt.Println(Red + "Couldn't copy " + *mirrorlist + ": " + err.Error() + Reset)
+	}
+
+	output, _ := json.MarshalIndent(captured, "", "  ")
+	if err := os.WriteFile(config_file, append(output, '\n'), 0644); err != nil {
+		fmt.Println(Red + "Couldn't write " + config_file + ": " + err.Error() + Reset)
+		os.Exit(1)
+	}
+	fmt.Println(Green + "Config written to " + config_file + Reset)
+}
+
+// runs a pacman query that prints one package per line
+func pacman_list(query string) ([]string, error) {
+	output, err := exec.Command("pacman", query).Output()
+	// pacman exits with 1 if the query has no results
+	if exit_err, ok := err.(*exec.ExitError); ok && exit_err.ExitCode() == 1 && len(output) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pacman %s failed: %w", query, err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// returns the repository of every package in the sync databases, e.g. {"linux": "core"}.
+// Packages in several repositories belong to the first one in pacman.conf
+func package_repositories() map[string]string {
+	repositories := map[string]string{}
+	output, _ := exec.Command("pacman", "-Sl").Output()
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if _, found := repositories[fields[1]]; !found {
+			repositories[fields[1]] = fields[0]
+		}
+	}
+	return repositories
+}
+
+// returns the pacman groups of the installed packages, e.g. {"kate": ["kde-applications", "kde-utilities"]}
+func installed_package_groups() map[string][]string {
+	groups := map[string][]string{}
+	output, _ := exec.Command("pacman", "-Qg").Output()
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			groups[fields[1]] = append(groups[fields[1]], fields[0])
+		}
+	}
+	return groups
+}
+
+// proposes package groups for the explicitly installed packages from the repository and the pacman groups
+// of every package. Foreign packages end up in "foreign" and packages that couldn't be grouped in "unsorted"
+func group_packages(explicit []string, foreign []string, repositories map[string]string, package_groups map[string][]string, group_by string) Packages {
+	groups := Packages{}
+	if group_by == "none" {
+		groups["unsorted"] = explicit
+		return groups
+	}
+	if group_by != "group" {
+		package_groups = nil
+	}
+
+	// a pacman group is used for the packages it contains if at least two of them are installed explicitly
+	members := map[string]int{}
+	for _, pkg := range explicit {
+		for _, group := range package_groups[pkg] {
+			members[group]++
+		}
+	}
+
+	for _, pkg := range explicit {
+		group := ""
+		for _, candidate := range package_groups[pkg] {
+			// packages of several groups are put in the largest one
+			if members[candidate] >= 2 && (group == "" || members[candidate] > members[group]) {
+				group = candidate
+			}
+		}
+		if group == "" {
+			group = repositories[pkg]
+		}
+		if group == "" && contains(foreign, pkg) {
+			group = "foreign"
+		}
+		if group == "" {
+			group = "unsorted"
+		}
+		groups[group] = append(groups[group], pkg)
+	}
+
+	for group := range groups {
+		sort.Strings(groups[group])
+	}
+	return groups
+}
+
+// returns the explicitly installed foreign packages as overlays, aur:<name> if the package is in the AUR.
+// The others need a PKGBUILD in the overlay directory
+func overlay_candidates(explicit []string, foreign []string) []string {
+	var candidates []string
+	for _, pkg := range foreign {
+		if contains(explicit, pkg) {
+			candidates = append(candidates, pkg)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	in_aur, err := aur_info(Config{Aur_url: default_aur_url}, candidates)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, Yellow+"Couldn't check the AUR for the foreign packages: "+err.Error()+Reset)
+	}
+
+	var overlays, without_source []string
+	for _, pkg := range candidates {
+		if _, found := in_aur[pkg]; found {
+			overlays = append(overlays, aur_prefix+pkg)
+		} else {
+			overlays = append(overlays, pkg)
+			without_source = append(without_source, pkg)
+		}
+	}
+	fmt.Fprintln(os.Stderr, Yellow+"Foreign packages were added as overlays: "+strings.Join(candidates, " ")+Reset)
+	if err == nil && len(without_source) > 0 {
+		fmt.Fprintln(os.Stderr, Yellow+"These need a PKGBUILD in the overlay directory: "+strings.Join(without_source, " ")+Reset)
+	}
+	return overlays
+}
+
+// returns the enabled system units. Templates like getty@.service can only be enabled as instance,
+// the enabled instances are taken from the links in the .wants and .requires directories of unit_dir
+func enabled_units(unit_dir string) []string {
+	output, err := exec.Command("systemctl", "list-unit-files", "--state=enabled", "--no-legend", "--no-pager").Output()
+	if err != nil {
+		return nil
+	}
+	var units []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && !strings.Contains(fields[0], "@.") {
+			units = append(units, fields[0])
+		}
+	}
+	return append(units, enabled_instances(unit_dir)...)
+}
+
+// returns the instances of template units that are enabled in unit_dir, e.g. getty@tty1.service
+func enabled_instances(unit_dir string) []string {
+	var links []string
+	for _, pattern := range []string{"*.wants/*@*", "*.requires/*@*"} {
+		matches, _ := filepath.Glob(filepath.Join(unit_dir, pattern))
+		links = append(links, matches...)
+	}
+
+	var instances []string
+	for _, link := range links {
+		name := filepath.Base(link)
+		if !strings.Contains(name, "@.") && !contains(instances, name) {
+			instances = append(instances, name)
+		}
+	}
+	sort.Strings(instances)
+	return instances
+}
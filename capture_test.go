@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGroupPackages(t *testing.T) {
+	explicit := []string{"linux", "vim", "kate", "dolphin", "konsole", "gimp", "yay", "local-tool"}
+	foreign := []string{"yay", "local-tool", "orphan"}
+	repositories := map[string]string{
+		"linux": "core", "vim": "extra", "kate": "extra", "dolphin": "extra", "konsole": "extra", "gimp": "extra",
+		// foreign packages that are also in a repository like chaotic-aur
+		"yay": "chaotic-aur",
+	}
+	package_groups := map[string][]string{
+		"kate":    {"kde-applications", "kde-utilities"},
+		"dolphin": {"kde-applications", "kde-system"},
+		"konsole": {"kde-applications", "kde-system"},
+		"gimp":    {"graphics"},
+	}
+
+	tests := []struct {
+		name     string
+		group_by string
+		want     Packages
+	}{
+		{
+			name:     "pacman groups and repositories",
+			group_by: "group",
+			want: Packages{
+				// kde-applications is the largest group, graphics has only one member and isn't used
+				"kde-applications": {"dolphin", "kate", "konsole"},
+				"core":             {"linux"},
+				"extra":            {"gimp", "vim"},
+				"chaotic-aur":      {"yay"},
+				"foreign":          {"local-tool"},
+			},
+		},
+		{
+			name:     "repositories",
+			group_by: "repo",
+			want: Packages{
+				"core":        {"linux"},
+				"extra":       {"dolphin", "gimp", "kate", "konsole", "vim"},
+				"chaotic-aur": {"yay"},
+				"foreign":     {"local-tool"},
+			},
+		},
+		{
+			name:     "unsorted",
+			group_by: "none",
+			want:     Packages{"unsorted": explicit},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if groups := group_packages(explicit, foreign, repositories, package_groups, test.group_by); !reflect.DeepEqual(groups, test.want) {
+				t.Errorf("group_packages() = %v, want %v", groups, test.want)
+			}
+		})
+	}
+
+	// packages without repository and that aren't foreign are unsorted
+	if groups := group_packages([]string{"gone"}, nil, repositories, package_groups, "group"); !reflect.DeepEqual(groups, Packages{"unsorted": {"gone"}}) {
+		t.Errorf("group_packages() = %v, want the package in unsorted", groups)
+	}
+}
+
+func TestEnabledInstances(t *testing.T) {
+	unit_dir := t.TempDir()
+	links := []string{
+		"getty.target.wants/getty@tty1.service",
+		"multi-user.target.wants/wg-quick@wg0.service",
+		"multi-user.target.wants/sshd.service",
+		"sockets.target.wants/systemd-userdbd.socket",
+		"sysinit.target.requires/foo@bar.service",
+		// the template itself, e.g. from WantedBy in the [Install] section of a template without DefaultInstance
+		"multi-user.target.wants/container@.service",
+		"default.target.wants/wg-quick@wg0.service",
+	}
+	for _, link := range links {
+		os.MkdirAll(filepath.Join(unit_dir, filepath.Dir(link)), os.FileMode(0755))
+		if err := os.Symlink("/usr/lib/systemd/system/"+filepath.Base(link), filepath.Join(unit_dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"foo@bar.service", "getty@tty1.service", "wg-quick@wg0.service"}
+	if instances := enabled_instances(unit_dir); !reflect.DeepEqual(instances, want) {
+		t.Errorf("enabled_instances() = %q, want %q", instances, want)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const default_archive_url = "https://archive.archlinux.org"
+
+// the Arch Linux Archive only contains x86_64 packages
+const archive_arch = "x86_64"
+
+// repositories that the Arch Linux Archive contains
+var archived_repository_regex = regexp.MustCompile(`^(core|extra|multilib)(-testing)?$`)
+
+// package in the repository database of an archive snapshot
+type ArchivePackage struct {
+	Entry      RepoEntry
+	Repository string
+	// date of the snapshot in the format YYYY_MM_DD
+	Date string
+}
+
+// returns the entries of the database of a repository in the archive snapshot of the date.
+// The databases are cached in the build directory
+func archive_repo_entries(config Config, repository string, date string) ([]RepoEntry, error) {
+	parts, err := snapshot_date(date)
+	if err != nil || parts == nil {
+		return nil, fmt.Errorf("invalid snapshot %s, use the format YYYY_MM_DD", date)
+	}
+
+	db_file := filepath.Join(config.Build_dir, "archive", date, repository+".db")
+	if _, err := os.Stat(db_file); err != nil {
+		os.MkdirAll(filepath.Dir(db_file), os.FileMode(0777))
+		url := fmt.Sprintf("%s/repos/%s/%s/%s/%s/os/%s/%s.db", strings.TrimRight(config.Archive_url, "/"), parts[0], parts[1], parts[2], repository, archive_arch, repository)
+		if err := download_file(url, db_file, nil); err != nil {
+			return nil, fmt.Errorf("couldn't download the database of %s from %s: %w", repository, date, err)
+		}
+	}
+	return read_repo_db(db_file)
+}
+
+// returns the official repositories of pacconfig in their order, the archive doesn't contain other repositories
+func archive_repositories(config Config) []string {
+	var repositories []string
+	for _, repository := range snapshot_repositories(config) {
+		if archived_repository_regex.MatchString(repository) {
+			repositories = append(repositories, repository)
+		}
+	}
+	return repositories
+}
+
+// finds the package that satisfies a dependency in the archive snapshot of the date, first by name and then
+// by provides. The repositories are searched in the given order, repositories that the snapshot doesn't
+// contain (e.g. a testing repository of an older date) are skipped
+func find_archive_package(config Config, repositories []string, databases map[string][]RepoEntry, dependency string, date string) (ArchivePackage, bool, error) {
+	name := dependency_name_regex.FindString(dependency)
+	for _, by_provides := range []bool{false, true} {
+		for _, repository := range repositories {
+			entries, loaded := databases[repository]
+			if !loaded {
+				var err error
+				entries, err = archive_repo_entries(config, repository, date)
+				if err != nil && !errors.Is(err, not_found_error) {
+					return ArchivePackage{}, false, err
+				}
+				databases[repository] = entries
+			}
+			for _, entry := range entries {
+				if !by_provides && entry.Name == name {
+					return ArchivePackage{Entry: entry, Repository: repository, Date: date}, true, nil
+				}
+				if by_provides {
+					for _, provided := range entry.Provides {
+						if dependency_name_regex.FindString(provided) == name {
+							return ArchivePackage{Entry: entry, Repository: repository, Date: date}, true, nil
+						}
+					}
+				}
+			}
+		}
+	}
+	return ArchivePackage{}, false, nil
+}
+
+// resolves a package in the archive snapshot of the date together with the dependencies that the installed
+// packages and the current repositories don't satisfy. Dependencies come before the packages that need them
+func resolve_cherry_pick(config Config, name string, date string) ([]ArchivePackage, error) {
+	repositories := archive_repositories(config)
+	if len(repositories) == 0 {
+		return nil, fmt.Errorf("%s doesn't include any of the official repositories", config.Pacconfig)
+	}
+	databases := map[string][]RepoEntry{}
+	var ordered []ArchivePackage
+	visited := map[string]bool{}
+
+	var visit func(dependency string, required_by string) error
+	visit = func(dependency string, required_by string) error {
+		pkg, found, err := find_archive_package(config, repositories, databases, dependency, date)
+		if err != nil {
+			return err
+		}
+		if !found && required_by == "" {
+			return fmt.Errorf("%s isn't in the snapshot %s", dependency, date)
+		} else if !found {
+			return fmt.Errorf("dependency %s of %s can't be satisfied by the snapshot %s", dependency, required_by, date)
+		}
+		if visited[pkg.Entry.Name] {
+			return nil
+		}
+		visited[pkg.Entry.Name] = true
+
+		for _, depends := range pkg.Entry.Depends {
+			if in_repositories(config, depends) {
+				continue
+			}
+			if err := visit(depends, pkg.Entry.Name); err != nil {
+				return err
+			}
+		}
+		ordered = append(ordered, pkg)
+		return nil
+	}
+
+	if err := visit(name, ""); err != nil {
+		return nil, err
+	}
+	return ordered, nil
+}
+
+// downloads a package file from the archive and verifies its checksum from the repository database
+// and its signature with the pacman keyring. returns the path of the package file
+func fetch_archive_package(config Config, pkg ArchivePackage) (string, error) {
+	package_file := filepath.Join(config.Build_dir, "archive", pkg.Date, pkg.Entry.Filename)
+	url := fmt.Sprintf("%s/packages/%s/%s/%s", strings.TrimRight(config.Archive_url, "/"), pkg.Entry.Name[:1], pkg.Entry.Name, pkg.Entry.Filename)
+
+	check_sha256 := func(temp_file string) error {
+		file, err := os.Open(temp_file)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return err
+		}
+		if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != pkg.Entry.Sha256 {
+			return fmt.Errorf("checksum of %s doesn't match the repository database", pkg.Entry.Filename)
+		}
+		return nil
+	}
+	if err := download_file(url, package_file, check_sha256); err != nil {
+		return "", err
+	}
+	if err := download_file(url+".sig", package_file+".sig", nil); err != nil {
+		return "", err
+	}
+
+	output, err := exec.Command("pacman-key", "--verify", package_file+".sig", package_file).CombinedOutput()
+	if err != nil {
+		os.Remove(package_file)
+		os.Remove(package_file + ".sig")
+		return "", fmt.Errorf("signature of %s is invalid: %s", pkg.Entry.Filename, strings.TrimSpace(string(output)))
+	}
+	return package_file, nil
+}
+
+// returns true if the snapshot of the repository a package was cherry-picked from reached the picked package:
+// if it is on or after the date of the pick or already contains the picked version. pacman would keep the
+// cherry-picked package of the local repository otherwise. snapshot is the snapshot of the run
+func cherry_pick_reached(configs Config, snapshot string, pkg string, locked LockedPackage) bool {
+	effective := snapshot
+	if repo_snapshot, found := configs.Repo_snapshots[locked.Repository]; found {
+		effective = repo_snapshot
+	}
+	switch effective {
+	case "":
+		// no update
+		return false
+	case "none", "rolling":
+		return true
+	}
+	// dates in the format YYYY_MM_DD are ordered like strings
+	if effective >= locked.Snapshot {
+		return true
+	}
+	if locked.Repository == "" {
+		return false
+	}
+	entries, err := archive_repo_entries(configs, locked.Repository, effective)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.Name == pkg {
+			return vercmp(entry.Version, locked.Version) >= 0
+		}
+	}
+	return false
+}
+
+// cherry-picks the packages of package_snapshots from their archive snapshots into the local repository.
+// Packages whose override was removed or that the snapshot reached are removed from the local repository
+// again so that the packages of the snapshot are used
+func cherry_pick_packages(configs Config, lock *Lockfile, snapshot string) {
+	var removed, reached []string
+	for _, pkg := range sorted_keys(lock.Packages) {
+		locked := lock.Packages[pkg]
+		if locked.Snapshot == "" {
+			continue
+		}
+		_, declared := configs.Package_snapshots[pkg]
+		_, parent_declared := configs.Package_snapshots[locked.Required_by]
+		if !declared && !parent_declared {
+			removed = append(removed, pkg)
+		} else if cherry_pick_reached(configs, snapshot, pkg, locked) {
+			reached = append(reached, pkg)
+		}
+	}
+
+	if len(configs.Package_snapshots) == 0 && len(removed) == 0 {
+		return
+	}
+	fmt.Println(Blue + "\nCherry-picking packages from newer snapshots" + Reset)
+
+	if len(removed) > 0 {
+		// installed versions are kept until the snapshot reaches them
+		fmt.Println("Removing cherry-picked packages without override from the local repository: " + strings.Join(removed, " "))
+	}
+	if len(reached) > 0 {
+		fmt.Println("Removing cherry-picked packages that the snapshot reached from the local repository: " + strings.Join(reached, " "))
+	}
+	if removed = append(removed, reached...); len(removed) > 0 {
+		if err := configs.Manager.remove_from_local_repo(configs, removed); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+		} else {
+			for _, pkg := range removed {
+				delete(lock.Packages, pkg)
+			}
+			if err := write_lockfile(configs, *lock); err != nil {
+				fmt.Println(Red + err.Error() + Reset)
+			}
+		}
+	}
+
+	for _, name := range sorted_keys(configs.Package_snapshots) {
+		date := configs.Package_snapshots[name]
+		if lock.Packages[name].Snapshot == date {
+			fmt.Println(Green + "Package " + name + " already cherry-picked from " + date + Reset)
+			continue
+		}
+
+		packages, err := resolve_cherry_pick(configs, name, date)
+		if err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			continue
+		}
+		for _, pkg := range packages {
+			picked := LockedPackage{Version: pkg.Entry.Version, Snapshot: pkg.Date, Repository: pkg.Repository}
+			if cherry_pick_reached(configs, snapshot, pkg.Entry.Name, picked) {
+				fmt.Println(Yellow + "The snapshot of " + pkg.Repository + " already reached " + pkg.Entry.Name + " " + pkg.Entry.Version + ", it isn't cherry-picked." + Reset)
+				if pkg.Entry.Name == name {
+					fmt.Println(Yellow + "The entry of " + name + " in package_snapshots can be removed." + Reset)
+				}
+				continue
+			}
+			if !cherry_pick_package(configs, lock, pkg, name) && pkg.Entry.Name != name {
+				fmt.Println(Red + "Skipping " + name + " since " + pkg.Entry.Name + " couldn't be cherry-picked." + Reset)
+				break
+			}
+		}
+	}
+}
+
+// adds a package from an archive snapshot to the local repository and records it in the lockfile.
+// name is the package of package_snapshots that needs it. returns false if it couldn't be added
+func cherry_pick_package(configs Config, lock *Lockfile, pkg ArchivePackage, name string) bool {
+	fmt.Printf("Cherry-picking %s %s from %s of %s\n", pkg.Entry.Name, pkg.Entry.Version, pkg.Repository, pkg.Date)
+	package_file, err := fetch_archive_package(configs, pkg)
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return false
+	}
+	if err := configs.Manager.add_to_local_repo(configs, []string{package_file}); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return false
+	}
+
+	state := PackageState{
+		Name:             pkg.Entry.Name,
+		Upstream_version: pkg.Entry.Version,
+		Version:          pkg.Entry.Version,
+		Packages:         []string{pkg.Entry.Name},
+		Snapshot:         pkg.Date,
+		Repository:       pkg.Repository,
+	}
+	if pkg.Entry.Name != name {
+		state.Required_by = name
+	}
+	lock_package(configs, lock, state)
+	return true
+}
+
+// returns the state of a cherry-picked package for the status command
+func cherry_pick_state(configs Config, lock Lockfile, name string, date string) PackageState {
+	locked := lock.Packages[name]
+	state := PackageState{Name: name, Version: locked.Version, Snapshot: date}
+	state.Installed_version = configs.Manager.query_installed(name)
+	switch {
+	case locked.Snapshot == "":
+		state.Reasons = append(state.Reasons, "not cherry-picked yet from "+date)
+	case locked.Snapshot != date:
+		state.Reasons = append(state.Reasons, "snapshot changed from "+locked.Snapshot+" to "+date)
+	}
+	state.Pending = len(state.Reasons) == 0 && state.Installed_version != state.Version
+	return state
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// repository databases of the test archive by date and repository
+var archive_test_databases = map[string]map[string][]RepoEntry{
+	"2024_12_01": {
+		"core": {
+			{Filename: "openssl-3.4.0-1-x86_64.pkg.tar.zst", Name: "openssl", Version: "3.4.0-1", Sha256: "aa", Depends: []string{"glibc", "libnewcrypto>=2"}},
+			{Filename: "broken-1.0-1-x86_64.pkg.tar.zst", Name: "broken", Version: "1.0-1", Sha256: "bb", Depends: []string{"nothing"}},
+		},
+		"extra": {
+			{Filename: "libnewcrypto-git-2.1-1-x86_64.pkg.tar.zst", Name: "libnewcrypto-git", Version: "2.1-1", Sha256: "cc", Depends: []string{"glibc"}, Provides: []string{"libnewcrypto=2.1"}},
+		},
+	},
+	"2024_11_20": {
+		"core": {
+			{Filename: "openssl-3.4.0-1-x86_64.pkg.tar.zst", Name: "openssl", Version: "3.4.0-1", Sha256: "aa"},
+			{Filename: "zlib-1:1.3-1-x86_64.pkg.tar.zst", Name: "zlib", Version: "1:1.3-1", Sha256: "dd"},
+		},
+	},
+}
+
+// writes a repository database as gzip compressed tar with a desc file per package
+func write_test_repo_db(t *testing.T, file string, entries []RepoEntry) {
+	os.MkdirAll(filepath.Dir(file), os.FileMode(0755))
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	compressed := gzip.NewWriter(out)
+	archive := tar.NewWriter(compressed)
+	for _, entry := range entries {
+		desc := "%FILENAME%\n" + entry.Filename + "\n\n%NAME%\n" + entry.Name + "\n\n%VERSION%\n" + entry.Version + "\n\n%SHA256SUM%\n" + entry.Sha256 + "\n\n"
+		if len(entry.Depends) > 0 {
+			desc += "%DEPENDS%\n" + strings.Join(entry.Depends, "\n") + "\n\n"
+		}
+		if len(entry.Provides) > 0 {
+			desc += "%PROVIDES%\n" + strings.Join(entry.Provides, "\n") + "\n\n"
+		}
+		archive.WriteHeader(&tar.Header{Name: entry.Name + "-" + entry.Version + "/desc", Mode: 0644, Size: int64(len(desc))})
+		archive.Write([]byte(desc))
+	}
+	archive.Close()
+	compressed.Close()
+}
+
+// serves archive_test_databases like the Arch Linux Archive and records the requested paths
+func archive_test_server(t *testing.T) (*httptest.Server, *[]string) {
+	if _, err := exec.LookPath("bsdtar"); err != nil {
+		t.Skip("bsdtar is needed to read repository databases")
+	}
+	root := t.TempDir()
+	for date, repositories := range archive_test_databases {
+		for repository, entries := range repositories {
+			write_test_repo_db(t, filepath.Join(root, "repos", strings.ReplaceAll(date, "_", "/"), repository, "os", archive_arch, repository+".db"), entries)
+		}
+	}
+
+	var requests []string
+	var mutex sync.Mutex
+	files := http.FileServer(http.Dir(root))
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		requests = append(requests, request.URL.Path)
+		mutex.Unlock()
+		files.ServeHTTP(writer, request)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestResolveCherryPick(t *testing.T) {
+	server, requests := archive_test_server(t)
+	pacconfig := filepath.Join(t.TempDir(), "pacman.conf")
+	os.WriteFile(pacconfig, []byte(`[options]
+Architecture = auto
+
+[core-testing]
+Include = /etc/pacman.d/mirrorlist
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+
+[extra]
+Include = /etc/pacman.d/mirrorlist
+
+[chaotic-aur]
+Include = /etc/pacman.d/mirrorlist
+`), 0644)
+
+	tests := []struct {
+		name string
+		pkg  string
+		want []string
+		err  bool
+	}{
+		{"dependencies by provides", "openssl", []string{"extra/libnewcrypto-git", "core/openssl"}, false},
+		{"dependency isn't available", "broken", nil, true},
+		{"not in the snapshot", "missing", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*requests = nil
+			// glibc is in the repositories
+			runner := &recording_runner{outputs: map[string]string{"pacman -T glibc": ""}}
+			config := Config{
+				Archive_url: server.URL,
+				Build_dir:   t.TempDir(),
+				Pacconfig:   pacconfig,
+				Mirrorlist:  "/home/user/nompac/mirrorlist",
+				Runner:      runner,
+			}
+
+			packages, err := resolve_cherry_pick(config, test.pkg, "2024_12_01")
+			if (err != nil) != test.err {
+				t.Fatalf("resolve_cherry_pick() error = %v", err)
+			}
+			var names []string
+			for _, pkg := range packages {
+				names = append(names, pkg.Repository+"/"+pkg.Entry.Name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("resolve_cherry_pick() = %q, want %q", names, test.want)
+			}
+			// the archive only contains the official repositories, core-testing of the date is missing
+			for _, path := range *requests {
+				if !strings.Contains(path, "/core-testing/") && !strings.Contains(path, "/core/") && !strings.Contains(path, "/extra/") {
+					t.Errorf("requested %s from the archive", path)
+				}
+			}
+		})
+	}
+}
+
+func TestCherryPickReached(t *testing.T) {
+	server, requests := archive_test_server(t)
+
+	tests := []struct {
+		name           string
+		snapshot       string
+		repo_snapshots map[string]string
+		pkg            string
+		locked         LockedPackage
+		want           bool
+	}{
+		{"no update", "", nil, "openssl", LockedPackage{Version: "3.4.0-1", Snapshot: "2024_12_01", Repository: "core"}, false},
+		{"rolling", "none", nil, "openssl", LockedPackage{Version: "3.4.0-1", Snapshot: "2024_12_01", Repository: "core"}, true},
+		{"snapshot after the pick", "2024_12_05", nil, "openssl", LockedPackage{Version: "3.4.0-1", Snapshot: "2024_12_01", Repository: "core"}, true},
+		{"snapshot of the pick", "2024_12_01", nil, "openssl", LockedPackage{Version: "3.4.0-1", Snapshot: "2024_12_01", Repository: "core"}, true},
+		{"snapshot contains the version", "2024_11_20", nil, "openssl", LockedPackage{Version: "3.4.0-1", Snapshot: "2024_12_01", Repository: "core"}, true},
+		{"snapshot contains an older version", "2024_11_20", nil, "zlib", LockedPackage{Version: "1:1.3.1-1", Snapshot: "2024_12_01", Repository: "core"}, false},
+		{"own snapshot of the repository", "2024_11_20", map[string]string{"core": "2024_12_02"}, "zlib", LockedPackage{Version: "1:1.3.1-1", Snapshot: "2024_12_01", Repository: "core"}, true},
+		{"own snapshot of another repository", "2024_12_02", map[string]string{"extra": "2024_11_20"}, "zlib", LockedPackage{Version: "1:1.3.1-1", Snapshot: "2024_12_01", Repository: "core"}, true},
+		{"lockfile without repository", "2024_11_20", nil, "openssl", LockedPackage{Version: "3.4.0-1", Snapshot: "2024_12_01"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*requests = nil
+			config := Config{Archive_url: server.URL, Build_dir: t.TempDir(), Repo_snapshots: test.repo_snapshots}
+			if reached := cherry_pick_reached(config, test.snapshot, test.pkg, test.locked); reached != test.want {
+				t.Errorf("cherry_pick_reached() = %v, want %v", reached, test.want)
+			}
+			if test.locked.Repository == "" && len(*requests) > 0 {
+				t.Errorf("requested %q without the repository of the pick", *requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// file that nompac installs from the config repository, given as source path or as object
+type ManagedFile struct {
+	// path of the file in the config repository, relative paths are relative to the config file
+	Source string `json:"source"`
+	// default root
+	Owner string `json:"owner"`
+	// default root
+	Group string `json:"group"`
+	// octal permissions, default 0644
+	Mode string `json:"mode"`
+}
+
+// managed file whose installed version differs from the declared one
+type FileChange struct {
+	Target string
+	File   ManagedFile
+	// what differs, e.g. "missing", "content", "symlink" or "mode 0600 -> 0644"
+	Differences []string
+}
+
+// accepts either a source path or an object
+func (file *ManagedFile) UnmarshalJSON(data []byte) error {
+	var source string
+	if err := json.Unmarshal(data, &source); err == nil {
+		*file = ManagedFile{Source: source}
+	} else {
+		type plain ManagedFile
+		var object plain
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		*file = ManagedFile(object)
+	}
+
+	if file.Source == "" {
+		return fmt.Errorf("managed file without source")
+	}
+	if file.Owner == "" {
+		file.Owner = "root"
+	}
+	if file.Group == "" {
+		file.Group = "root"
+	}
+	if file.Mode == "" {
+		file.Mode = "0644"
+	}
+	if _, err := strconv.ParseUint(file.Mode, 8, 32); err != nil {
+		return fmt.Errorf("invalid mode %s of %s, use octal permissions like 0644", file.Mode, file.Source)
+	}
+	return nil
+}
+
+func (file ManagedFile) mode() os.FileMode {
+	mode, _ := strconv.ParseUint(file.Mode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// reads a file, files that are only readable by root are read with sudo
+func read_system_file(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsPermission(err) {
+		return exec.Command("sudo", "cat", path).Output()
+	}
+	return contents, err
+}
+
+// returns the name of the user and the group that own a file
+func file_owner(info os.FileInfo) (string, string) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+	owner := strconv.Itoa(int(stat.Uid))
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group := strconv.Itoa(int(stat.Gid))
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner, group
+}
+
+// compares the installed managed files with their sources in the config repository.
+// Changes of the installed files outside of nompac show up as differences as well and are overwritten
+func file_changes(config Config) []FileChange {
+	var changes []FileChange
+	for _, target := range sorted_keys(config.Files) {
+		file := config.Files[target]
+		source, err := os.ReadFile(file.Source)
+		if err != nil {
+			fmt.Println(Red + "Couldn't read source of " + target + ": " + err.Error() + Reset)
+			continue
+		}
+
+		info, err := os.Lstat(target)
+		if err != nil {
+			changes = append(changes, FileChange{Target: target, File: file, Differences: []string{"missing"}})
+			continue
+		}
+
+		var differences []string
+		if installed, err := read_system_file(target); err != nil || !bytes.Equal(installed, source) {
+			differences = append(differences, "content")
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			// install replaces the link with a copy of the source, the mode of the link itself is always 0777
+			differences = append(differences, "symlink")
+		} else {
+			if info.Mode().Perm() != file.mode() {
+				differences = append(differences, fmt.Sprintf("mode %04o -> %04o", info.Mode().Perm(), file.mode()))
+			}
+			if owner, group := file_owner(info); owner != file.Owner || group != file.Group {
+				differences = append(differences, fmt.Sprintf("owner %s:%s -> %s:%s", owner, group, file.Owner, file.Group))
+			}
+		}
+		if len(differences) > 0 {
+			changes = append(changes, FileChange{Target: target, File: file, Differences: differences})
+		}
+	}
+	return changes
+}
+
+// installs the managed files that differ from their sources
+func apply_files(config Config, changes []FileChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	fmt.Println(Blue + "Installing the managed files:" + Reset)
+	reload_units := false
+	for _, change := range changes {
+		file := change.File
+		command := fmt.Sprintf("sudo install -D -o %s -g %s -m %s %s %s", file.Owner, file.Group, file.Mode, file.Source, change.Target)
+		if err := config.Runner.run(command); err != nil {
+			fmt.Println(Red + "Couldn't install " + change.Target + ": " + err.Error() + Reset)
+			continue
+		}
+		if strings.HasPrefix(change.Target, "/etc/systemd/") {
+			reload_units = true
+		}
+	}
+	// systemd only reads changed unit files after a reload
+	if reload_units {
+		config.Runner.run("sudo systemctl daemon-reload")
+	}
+}
+
+// returns the file name extensions of the new and saved config files of the package manager
+func config_backup_suffixes(config Config) []string {
+	if config.Manager.name() == "zypper" {
+		return []string{".rpmnew", ".rpmsave"}
+	}
+	return []string{".pacnew", ".pacsave"}
+}
+
+// returns the .pacnew and .pacsave files. pacdiff finds them through the pacman database, with zypper
+// /etc is searched as root. If that fails, the directories of /etc that are readable without root are searched
+func find_config_backups(config Config) []string {
+	suffixes := config_backup_suffixes(config)
+	command := "pacdiff --output"
+	if config.Manager.name() != "pacman" {
+		command = fmt.Sprintf("sudo find /etc -name '*%s' -o -name '*%s'", suffixes[0], suffixes[1])
+	}
+	output, err := config.Runner.output(command)
+	if err != nil {
+		return walk_config_backups(suffixes)
+	}
+
+	var backups []string
+	for _, line := range strings.Split(string(output), "\n") {
+		for _, suffix := range suffixes {
+			// pacdiff also lists .pacorig files
+			if strings.HasSuffix(line, suffix) {
+				backups = append(backups, line)
+			}
+		}
+	}
+	return backups
+}
+
+// returns the files in /etc with one of the suffixes
+func walk_config_backups(suffixes []string) []string {
+	var backups []string
+	filepath.WalkDir("/etc", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// directories that are only readable by root are skipped
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(path, suffix) {
+				backups = append(backups, path)
+			}
+		}
+		return nil
+	})
+	return backups
+}
+
+// lists the .pacnew and .pacsave files after a package transaction and opens them with diffprog.
+// For managed files, the new version is compared with the source in the config repository since
+// nompac overwrites the installed file anyway
+func check_config_backups(config Config) {
+	backups := find_config_backups(config)
+	if len(backups) == 0 {
+		return
+	}
+
+	fmt.Println(Yellow + "The package manager left the following config files to merge:" + Reset)
+	for _, backup := range backups {
+		target := backup[:len(backup)-len(filepath.Ext(backup))]
+		if file, managed := config.Files[target]; managed {
+			fmt.Printf("  %s (managed, merge into %s)\n", backup, file.Source)
+		} else {
+			fmt.Println("  " + backup)
+		}
+	}
+
+	if config.Diffprog == "" || !is_interactive() {
+		return
+	}
+	for _, backup := range backups {
+		target := backup[:len(backup)-len(filepath.Ext(backup))]
+		command := fmt.Sprintf("sudo %s %s %s", config.Diffprog, target, backup)
+		if file, managed := config.Files[target]; managed {
+			command = fmt.Sprintf("%s %s %s", config.Diffprog, file.Source, backup)
+		}
+		if err := config.Runner.run(command); err != nil {
+			fmt.Println(Red + "Couldn't merge " + backup + ": " + err.Error() + Reset)
+			continue
+		}
+		fmt.Println("Remove " + backup + " once the changes are merged.")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileChanges(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.conf")
+	os.WriteFile(source, []byte("key = value\n"), 0644)
+	info, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test runs as any user, the files it creates belong to that user
+	owner, group := file_owner(info)
+
+	tests := []struct {
+		name        string
+		contents    string
+		mode        os.FileMode
+		file        ManagedFile
+		symlink     bool
+		differences []string
+	}{
+		{
+			name:        "missing",
+			file:        ManagedFile{Owner: owner, Group: group, Mode: "0644"},
+			differences: []string{"missing"},
+		},
+		{
+			name:     "up to date",
+			contents: "key = value\n",
+			mode:     0644,
+			file:     ManagedFile{Owner: owner, Group: group, Mode: "0644"},
+		},
+		{
+			name:        "content",
+			contents:    "key = other\n",
+			mode:        0644,
+			file:        ManagedFile{Owner: owner, Group: group, Mode: "0644"},
+			differences: []string{"content"},
+		},
+		{
+			name:        "mode",
+			contents:    "key = value\n",
+			mode:        0600,
+			file:        ManagedFile{Owner: owner, Group: group, Mode: "0644"},
+			differences: []string{"mode 0600 -> 0644"},
+		},
+		{
+			name:        "owner",
+			contents:    "key = value\n",
+			mode:        0644,
+			file:        ManagedFile{Owner: "nompac-test", Group: group, Mode: "0644"},
+			differences: []string{"owner " + owner + ":" + group + " -> nompac-test:" + group},
+		},
+		{
+			name:        "symlink",
+			contents:    "key = value\n",
+			mode:        0644,
+			file:        ManagedFile{Owner: owner, Group: group, Mode: "0644"},
+			symlink:     true,
+			differences: []string{"symlink"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "target.conf")
+			if test.contents != "" {
+				installed := target
+				if test.symlink {
+					installed = target + ".real"
+					if err := os.Symlink(installed, target); err != nil {
+						t.Fatal(err)
+					}
+				}
+				os.WriteFile(installed, []byte(test.contents), test.mode)
+				// the umask can change the mode of the new file
+				os.Chmod(installed, test.mode)
+			}
+			test.file.Source = source
+			config := Config{Files: map[string]ManagedFile{target: test.file}}
+
+			var want []FileChange
+			if len(test.differences) > 0 {
+				want = []FileChange{{Target: target, File: test.file, Differences: test.differences}}
+			}
+			if changes := file_changes(config); !reflect.DeepEqual(changes, want) {
+				t.Errorf("file_changes() = %+v, want %+v", changes, want)
+			}
+		})
+	}
+}
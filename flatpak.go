@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Flatpak applications that are installed declaratively
+type Flatpaks struct {
+	// remotes by name with the URL of their .flatpakrepo file, e.g. {"flathub": "https://dl.flathub.org/repo/flathub.flatpakrepo"}
+	Remotes map[string]string `json:"remotes"`
+	// applications per package group
+	Apps map[string][]FlatpakApp `json:"apps"`
+	// installation the applications are managed in, "system" (default) or "user"
+	Installation string `json:"installation"`
+}
+
+// Flatpak application, given as app ID or as object with a remote and pins
+type FlatpakApp struct {
+	Id string `json:"id"`
+	// remote to install from, default is the only configured remote
+	Remote string `json:"remote"`
+	// branch of the application, e.g. "stable"
+	Branch string `json:"branch"`
+	// commit the application is pinned to, it is masked so that updates don't replace it
+	Commit string `json:"commit"`
+}
+
+// accepts either an app ID or an object
+func (app *FlatpakApp) UnmarshalJSON(data []byte) error {
+	var id string
+	if err := json.Unmarshal(data, &id); err == nil {
+		*app = FlatpakApp{Id: id}
+		return nil
+	}
+
+	type plain FlatpakApp
+	var object plain
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	if object.Id == "" {
+		return fmt.Errorf("flatpak app without id")
+	}
+	*app = FlatpakApp(object)
+	return nil
+}
+
+// returns the ref of the application for flatpak install, e.g. org.gimp.GIMP//stable
+func (app FlatpakApp) ref() string {
+	if app.Branch == "" {
+		return app.Id
+	}
+	return app.Id + "//" + app.Branch
+}
+
+// returns --system or --user
+func flatpak_installation(config Config) string {
+	if config.Flatpaks.Installation == "user" {
+		return "--user"
+	}
+	return "--system"
+}
+
+// returns the declared applications of the selected package groups
+func declared_flatpaks(config Config, groups []string) []FlatpakApp {
+	var apps []FlatpakApp
+	var ids []string
+	for _, group := range sorted_keys(config.Flatpaks.Apps) {
+		if !group_selected(groups, group) {
+			continue
+		}
+		for _, app := range config.Flatpaks.Apps[group] {
+			if !contains(ids, app.Id) {
+				ids = append(ids, app.Id)
+				apps = append(apps, app)
+			}
+		}
+	}
+	return apps
+}
+
+// returns the IDs of the installed applications, nil if flatpak isn't installed
+func installed_flatpaks(config Config) ([]string, error) {
+	if _, err := config.Runner.output("command -v flatpak"); err != nil {
+		return nil, nil
+	}
+	output, err := config.Runner.output("flatpak list " + flatpak_installation(config) + " --app --columns=application")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get list of installed flatpaks: %w", err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// returns the commit of an installed application
+func installed_flatpak_commit(config Config, id string) string {
+	output, err := config.Runner.output("flatpak info " + flatpak_installation(config) + " --show-commit " + id)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// adds the differences of the installed and the declared applications to the plan
+func plan_flatpaks(config Config, groups []string, plan *Plan) {
+	if len(config.Flatpaks.Apps) == 0 {
+		// flatpaks aren't managed by nompac
+		return
+	}
+	declared := declared_flatpaks(config, groups)
+
+	installed, err := installed_flatpaks(config)
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return
+	}
+
+	var declared_ids []string
+	for _, app := range declared {
+		declared_ids = append(declared_ids, app.Id)
+		switch {
+		case !contains(installed, app.Id):
+			plan.Flatpaks_to_install = append(plan.Flatpaks_to_install, app)
+		case app.Commit != "" && !strings.HasPrefix(installed_flatpak_commit(config, app.Id), app.Commit):
+			plan.Flatpaks_to_pin = append(plan.Flatpaks_to_pin, app)
+		}
+	}
+	for _, id := range installed {
+		if !contains(declared_ids, id) {
+			plan.Flatpaks_to_remove = append(plan.Flatpaks_to_remove, id)
+		}
+	}
+}
+
+// installs, pins, removes and updates the applications of the plan
+func apply_flatpaks(config Config, plan Plan) {
+	if len(config.Flatpaks.Apps) == 0 {
+		return
+	}
+	installation := flatpak_installation(config)
+	runner := config.Runner
+
+	for _, remote := range sorted_keys(config.Flatpaks.Remotes) {
+		if err := runner.run(fmt.Sprintf("flatpak remote-add %s --if-not-exists %s %s", installation, remote, config.Flatpaks.Remotes[remote])); err != nil {
+			fmt.Println(Red + "Couldn't add flatpak remote " + remote + Reset)
+		}
+	}
+
+	if len(plan.Flatpaks_to_remove) > 0 {
+		fmt.Println(Red + "Removing the following flatpaks since they don't exist in the config file:" + Reset)
+		fmt.Println(" " + strings.Join(plan.Flatpaks_to_remove, " "))
+		if err := runner.run(fmt.Sprintf("flatpak uninstall %s --noninteractive %s", installation, strings.Join(plan.Flatpaks_to_remove, " "))); err != nil {
+			fmt.Println(Red + "Couldn't remove flatpaks " + strings.Join(plan.Flatpaks_to_remove, " ") + Reset)
+		}
+	}
+
+	for _, app := range plan.Flatpaks_to_install {
+		remote := app.Remote
+		if remote == "" && len(config.Flatpaks.Remotes) == 1 {
+			remote = sorted_keys(config.Flatpaks.Remotes)[0]
+		}
+		fmt.Println(Blue + "Installing flatpak " + app.ref() + Reset)
+		if err := runner.run(fmt.Sprintf("flatpak install %s --noninteractive %s %s", installation, remote, app.ref())); err != nil {
+			fmt.Println(Red + "Couldn't install flatpak " + app.Id + Reset)
+			continue
+		}
+		if app.Commit != "" {
+			plan.Flatpaks_to_pin = append(plan.Flatpaks_to_pin, app)
+		}
+	}
+
+	// pinned applications are masked so that flatpak update keeps the commit
+	for _, app := range plan.Flatpaks_to_pin {
+		fmt.Println(Blue + "Pinning flatpak " + app.Id + " to commit " + app.Commit + Reset)
+		if err := runner.run(fmt.Sprintf("flatpak update %s --noninteractive --commit=%s %s && flatpak mask %s %s", installation, app.Commit, app.ref(), installation, app.Id)); err != nil {
+			fmt.Println(Red + "Couldn't pin flatpak " + app.Id + Reset)
+		}
+	}
+
+	runner.run("flatpak update " + installation + " --noninteractive")
+}
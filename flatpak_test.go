@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanFlatpaks(t *testing.T) {
+	apps := map[string][]FlatpakApp{
+		"base":     {{Id: "org.mozilla.firefox"}, {Id: "org.gimp.GIMP", Branch: "stable", Commit: "abc123"}},
+		"games":    {{Id: "com.valvesoftware.Steam"}},
+		"multiple": {{Id: "org.mozilla.firefox"}},
+	}
+
+	tests := []struct {
+		name      string
+		groups    []string
+		outputs   map[string]string
+		installed []string
+		removed   []string
+		pinned    []string
+	}{
+		{
+			name:      "nothing installed",
+			groups:    []string{"base"},
+			outputs:   map[string]string{"flatpak list --system --app --columns=application": ""},
+			installed: []string{"org.mozilla.firefox", "org.gimp.GIMP"},
+		},
+		{
+			name:   "undeclared and unselected applications are removed",
+			groups: []string{"base", "multiple"},
+			outputs: map[string]string{
+				"flatpak list --system --app --columns=application": "org.mozilla.firefox\norg.gimp.GIMP\ncom.valvesoftware.Steam\norg.kde.kdenlive\n",
+				"flatpak info --system --show-commit org.gimp.GIMP": "abc123def456\n",
+			},
+			removed: []string{"com.valvesoftware.Steam", "org.kde.kdenlive"},
+		},
+		{
+			name:   "pinned application at another commit",
+			groups: []string{"all"},
+			outputs: map[string]string{
+				"flatpak list --system --app --columns=application": "org.mozilla.firefox\norg.gimp.GIMP\n",
+				"flatpak info --system --show-commit org.gimp.GIMP": "fff000\n",
+			},
+			installed: []string{"com.valvesoftware.Steam"},
+			pinned:    []string{"org.gimp.GIMP"},
+		},
+		{
+			// flatpak is installed with the packages before the applications
+			name:      "flatpak isn't installed",
+			groups:    []string{"all"},
+			outputs:   map[string]string{},
+			installed: []string{"org.mozilla.firefox", "org.gimp.GIMP", "com.valvesoftware.Steam"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, found := test.outputs["flatpak list --system --app --columns=application"]; found {
+				test.outputs["command -v flatpak"] = "/usr/bin/flatpak\n"
+			}
+			config := Config{Flatpaks: Flatpaks{Apps: apps}, Runner: &recording_runner{outputs: test.outputs}}
+
+			var plan Plan
+			plan_flatpaks(config, test.groups, &plan)
+
+			ids := func(apps []FlatpakApp) []string {
+				var ids []string
+				for _, app := range apps {
+					ids = append(ids, app.Id)
+				}
+				return ids
+			}
+			if installed := ids(plan.Flatpaks_to_install); !reflect.DeepEqual(installed, test.installed) {
+				t.Errorf("Flatpaks_to_install = %q, want %q", installed, test.installed)
+			}
+			if !reflect.DeepEqual(plan.Flatpaks_to_remove, test.removed) {
+				t.Errorf("Flatpaks_to_remove = %q, want %q", plan.Flatpaks_to_remove, test.removed)
+			}
+			if pinned := ids(plan.Flatpaks_to_pin); !reflect.DeepEqual(pinned, test.pinned) {
+				t.Errorf("Flatpaks_to_pin = %q, want %q", pinned, test.pinned)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// overlay whose PKGBUILD nompac renders from a template and a list of components,
+// e.g. a meta package that bundles several emacs packages
+type GeneratedOverlay struct {
+	// template of the PKGBUILD in the overlay directory of the package, default PKGBUILD.tmpl
+	Template string `json:"template"`
+	// pkgver of the generated package, default 1.0.0. pkgrel is bumped whenever a component changes
+	Pkgver     string      `json:"pkgver"`
+	Components []Component `json:"components"`
+}
+
+// part of a generated overlay
+type Component struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// URL template of the source, e.g. "https://github.com/minad/{{.Name}}/archive/refs/tags/{{.Version}}.tar.gz"
+	Source string `json:"source"`
+	// where newer versions of the component are looked up, optional
+	Upstream *OverlaySource `json:"upstream"`
+}
+
+// component as it is passed to the PKGBUILD template
+type RenderedComponent struct {
+	Name    string
+	Version string
+	// file name of the source in srcdir, use {{.File}}::{{.Source}} in the source array
+	File   string
+	Source string
+	Sha256 string
+}
+
+// line of the generated PKGBUILD that records the hash of the components it was rendered from
+const components_hash_prefix = "# nompac components: "
+
+// file name extensions of sources that are kept for the file name in srcdir
+var source_extensions = []string{".tar.gz", ".tar.xz", ".tar.zst", ".tar.bz2", ".tgz", ".zip", ".el"}
+
+// renders the PKGBUILDs of all generated overlays
+func generate_overlays(config Config) bool {
+	all_ok := true
+	for _, pkg := range sorted_keys(config.Generated_overlays) {
+		if err := generate_overlay(config, pkg); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			all_ok = false
+		}
+	}
+	return all_ok
+}
+
+// renders the PKGBUILD of a generated overlay if the components, pkgver or the template changed.
+// The sources of the components are downloaded to the source cache to compute their checksums
+func generate_overlay(config Config, pkg string) error {
+	spec := config.Generated_overlays[pkg]
+	overlay_dir := filepath.Join(config.Overlay_dir, pkg)
+	if spec.Template == "" {
+		spec.Template = "PKGBUILD.tmpl"
+	}
+	if spec.Pkgver == "" {
+		spec.Pkgver = "1.0.0"
+	}
+
+	template_file := filepath.Join(overlay_dir, spec.Template)
+	template_text, err := os.ReadFile(template_file)
+	if err != nil {
+		return fmt.Errorf("couldn't read template of %s: %w", pkg, err)
+	}
+	pkgbuild_template, err := template.New(spec.Template).Parse(string(template_text))
+	if err != nil {
+		return fmt.Errorf("invalid template of %s: %w", pkg, err)
+	}
+
+	var components []RenderedComponent
+	for _, component := range spec.Components {
+		rendered, err := render_component(component)
+		if err != nil {
+			return fmt.Errorf("component %s of %s: %w", component.Name, pkg, err)
+		}
+		components = append(components, rendered)
+	}
+
+	hash := sha256.New()
+	settings, _ := json.Marshal(components)
+	hash.Write(settings)
+	hash.Write(template_text)
+	hash.Write([]byte(spec.Pkgver))
+	components_hash := hex.EncodeToString(hash.Sum(nil))
+
+	pkgbuild_file := filepath.Join(overlay_dir, "PKGBUILD")
+	old_hash, old_pkgver, old_pkgrel := read_generated_pkgbuild(pkgbuild_file)
+	if old_hash == components_hash {
+		return nil
+	}
+
+	pkgrel := 1
+	if old_pkgver == spec.Pkgver {
+		pkgrel = old_pkgrel + 1
+	}
+	fmt.Printf("Generating PKGBUILD of %s %s-%d\n", pkg, spec.Pkgver, pkgrel)
+
+	srcdest := prepare_srcdest(config, pkg)
+	for i := range components {
+		checksum, err := component_checksum(config, srcdest, components[i])
+		if err != nil {
+			return fmt.Errorf("component %s of %s: %w", components[i].Name, pkg, err)
+		}
+		components[i].Sha256 = checksum
+	}
+
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "# generated by nompac from %s, changes are overwritten\n", spec.Template)
+	fmt.Fprintln(&output, components_hash_prefix+components_hash)
+	err = pkgbuild_template.Execute(&output, struct {
+		Pkgname    string
+		Pkgver     string
+		Pkgrel     int
+		Components []RenderedComponent
+	}{pkg, spec.Pkgver, pkgrel, components})
+	if err != nil {
+		return fmt.Errorf("couldn't render template of %s: %w", pkg, err)
+	}
+
+	temp_file := pkgbuild_file + ".tmp"
+	if err := os.WriteFile(temp_file, output.Bytes(), 0644); err != nil {
+		return fmt.Errorf("couldn't write PKGBUILD of %s: %w", pkg, err)
+	}
+	return os.Rename(temp_file, pkgbuild_file)
+}
+
+// fills in the URL template of a component and derives the file name of the source
+func render_component(component Component) (RenderedComponent, error) {
+	rendered := RenderedComponent{Name: component.Name, Version: component.Version}
+
+	source_template, err := template.New(component.Name).Parse(component.Source)
+	if err != nil {
+		return rendered, fmt.Errorf("invalid source: %w", err)
+	}
+	var source strings.Builder
+	if err := source_template.Execute(&source, component); err != nil {
+		return rendered, fmt.Errorf("invalid source: %w", err)
+	}
+	rendered.Source = source.String()
+
+	rendered.File = component.Name + "-" + component.Version
+	for _, extension := range source_extensions {
+		if strings.HasSuffix(path.Base(rendered.Source), extension) {
+			rendered.File += extension
+			break
+		}
+	}
+	return rendered, nil
+}
+
+// returns the sha256 checksum of the source of a component, the source is downloaded to the source cache
+// and linked into the SRCDEST of the package where makepkg finds it during the build
+func component_checksum(config Config, srcdest string, component RenderedComponent) (string, error) {
+	file := filepath.Join(srcdest, component.File)
+	if _, err := os.Stat(file); err != nil {
+		// the link is left over if the cached source was evicted
+		os.Remove(file)
+		if err := download_file(component.Source, file, nil); err != nil {
+			return "", err
+		}
+		if err := cache_source(config, file); err != nil {
+			return "", err
+		}
+	}
+	return file_sha256(file)
+}
+
+// returns the components hash, pkgver and pkgrel of a generated PKGBUILD
+func read_generated_pkgbuild(file string) (string, string, int) {
+	pkgbuild, err := read_pkgbuild(file)
+	if err != nil {
+		return "", "", 0
+	}
+	pkgrel, _ := strconv.Atoi(pkgbuild.value("pkgrel"))
+
+	components_hash := ""
+	scanner := bufio.NewScanner(strings.NewReader(pkgbuild.String()))
+	for scanner.Scan() {
+		if hash, found := strings.CutPrefix(scanner.Text(), components_hash_prefix); found {
+			components_hash = hash
+			break
+		}
+	}
+	return components_hash, pkgbuild.value("pkgver"), pkgrel
+}
+
+// reports components of generated overlays with newer upstream versions.
+// returns false if a source couldn't be checked
+func components_outdated(config Config) bool {
+	all_ok := true
+	for _, pkg := range sorted_keys(config.Generated_overlays) {
+		for _, component := range config.Generated_overlays[pkg].Components {
+			if component.Upstream == nil {
+				continue
+			}
+			latest, err := latest_release(*component.Upstream)
+			if err != nil {
+				fmt.Printf(Red+"  %s/%s: %s\n"+Reset, pkg, component.Name, err)
+				all_ok = false
+				continue
+			}
+			if vercmp(latest, component.Version) > 0 {
+				fmt.Printf(Yellow+"  %s/%s: %s -> %s\n"+Reset, pkg, component.Name, component.Version, latest)
+			} else {
+				fmt.Printf(Green+"  %s/%s: %s is up to date\n"+Reset, pkg, component.Name, component.Version)
+			}
+		}
+	}
+	return all_ok
+}
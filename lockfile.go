@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// state of the packages nompac built, kept as JSON in the state directory
+type Lockfile struct {
+	Packages map[string]LockedPackage `json:"packages"`
+	// hashes of the contents of the downloaded upstream tarballs by file name, recorded on the first download
+	Tarballs map[string]string `json:"tarballs,omitempty"`
+}
+
+// build of a package in the local repository
+type LockedPackage struct {
+	// version of the package in the official repositories or the overlay the build is based on
+	Upstream_version string `json:"upstream_version"`
+	// hash of the inputs of the build: patches and overrides or the files of the overlay
+	Input_hash string `json:"input_hash"`
+	// number that is appended to pkgrel, bumped when the patches or the overlay files change
+	Local_release int `json:"local_release"`
+	// version of the built package
+	Version string `json:"version"`
+	// names of the published packages, a split PKGBUILD produces several packages
+	Packages []string `json:"packages,omitempty"`
+	// AUR package that pulled in this package as dependency
+	Required_by string `json:"required_by,omitempty"`
+	// archive date of a package that was cherry-picked from a newer snapshot
+	Snapshot string `json:"snapshot,omitempty"`
+	// repository the package was cherry-picked from
+	Repository string `json:"repository,omitempty"`
+}
+
+func lockfile_path(config Config) string {
+	return filepath.Join(config.State_dir, "nompac.lock")
+}
+
+// reads the lockfile, a missing lockfile results in an empty one
+func read_lockfile(config Config) Lockfile {
+	lock := Lockfile{Packages: map[string]LockedPackage{}, Tarballs: map[string]string{}}
+
+	contents, err := os.ReadFile(lockfile_path(config))
+	if err != nil {
+		return lock
+	}
+	if err := json.Unmarshal(contents, &lock); err != nil {
+		fmt.Println(Red + "Couldn't parse lockfile " + lockfile_path(config) + ": " + err.Error() + Reset)
+	}
+	if lock.Packages == nil {
+		lock.Packages = map[string]LockedPackage{}
+	}
+	if lock.Tarballs == nil {
+		lock.Tarballs = map[string]string{}
+	}
+	return lock
+}
+
+// writes the lockfile atomically so that an interrupted run doesn't leave a truncated file
+func write_lockfile(config Config, lock Lockfile) error {
+	contents, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lockfile: %w", err)
+	}
+
+	if err := os.MkdirAll(config.State_dir, os.FileMode(0755)); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	temp_file := lockfile_path(config) + ".tmp"
+	if err := os.WriteFile(temp_file, append(contents, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+	return os.Rename(temp_file, lockfile_path(config))
+}
+
+// hashes the patch settings, the contents of the patch files and the override of a package
+func upstream_input_hash(config Config, packagename string, patches []PatchSpec) string {
+	hash := sha256.New()
+
+	for _, patch := range patches {
+		settings, _ := json.Marshal(patch)
+		hash.Write(settings)
+		contents, err := os.ReadFile(filepath.Join(config.Patch_dir, packagename, patch.File))
+		if err != nil {
+			fmt.Printf("Couldn't read patch %s: %s\n", patch.File, err)
+		}
+		hash.Write(contents)
+	}
+
+	if override, ok := config.Overrides[packagename]; ok {
+		settings, _ := json.Marshal(override)
+		hash.Write(settings)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// hashes the names, permissions and contents of all files in the overlay directory of a package
+func overlay_input_hash(config Config, packagename string) string {
+	hash := sha256.New()
+
+	overlay_dir := filepath.Join(config.Overlay_dir, packagename)
+	// WalkDir visits the files in lexical order, so the hash doesn't depend on the order of the directory entries
+	filepath.WalkDir(overlay_dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		// backup files of editors aren't used for the build
+		if strings.HasSuffix(entry.Name(), "~") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(overlay_dir, path)
+		fmt.Fprintf(hash, "%s %o %d\n", relative, info.Mode().Perm(), len(contents))
+		hash.Write(contents)
+		return nil
+	})
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
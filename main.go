@@ -2,9 +2,11 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,6 +16,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -34,10 +37,14 @@ type Args struct {
 	config         string
 	package_groups string
 	initiate       string
+	accept         bool
+	dry_run        bool
+	command        []string
 }
 
-// Define a struct for the Patches part of the JSON
-type Patches map[string][]string
+// Define a struct for the Patches part of the JSON.
+// Patches are given as file name or as object with additional settings (see PatchSpec)
+type Patches map[string][]PatchSpec
 
 // Define a struct for the Packages part of the JSON
 type Packages map[string][]string
@@ -56,6 +63,55 @@ type Config struct {
 	Pacconfig     string     `json:"pacconfig"`
 	Mirrorlist    string     `json:"mirrorlist"`
 	Snapshot      string     `json:"snapshot"`
+	Repo_keep     int        `json:"repo_keep"`
+	Sign_key      string     `json:"sign_key"`
+	State_dir     string     `json:"state_dir"`
+	// declarative changes of the PKGBUILDs of packages from the official repositories
+	Overrides map[string]Override `json:"overrides"`
+	// ask for approval before building a patched package whose upstream files changed
+	Review_upstream bool `json:"review_upstream"`
+	// digits that are put in front of the local release number in pkgrel, "none" disables the local release
+	Local_suffix string `json:"local_suffix"`
+	// directory with public keys named <fingerprint>.asc for the validpgpkeys of PKGBUILDs
+	Pgp_keyring string `json:"pgp_keyring"`
+	// packages whose sources are built without PGP verification
+	Skip_pgp_check []string `json:"skip_pgp_check"`
+	// upstream sources of overlays that are checked for new releases
+	Overlay_sources map[string]OverlaySource `json:"overlay_sources"`
+	// overlays whose PKGBUILD is rendered from a template and a list of components
+	Generated_overlays map[string]GeneratedOverlay `json:"generated_overlays"`
+	// Flatpak remotes and applications per package group
+	Flatpaks Flatpaks `json:"flatpaks"`
+	// systemd units per package group with their declared state
+	Services map[string][]Service `json:"services"`
+	// snapshot dates of single repositories that differ from snapshot, e.g. {"multilib": "2024_10_01"}
+	Repo_snapshots map[string]string `json:"repo_snapshots"`
+	// packages that are cherry-picked from a newer snapshot into the local repository, e.g. {"openssl": "2024_12_01"}
+	Package_snapshots map[string]string `json:"package_snapshots"`
+	// base URL of the archive the cherry-picked packages are fetched from
+	Archive_url string `json:"archive_url"`
+	// archive mirrors for snapshots and the mirrors of rolling mode
+	Mirrors MirrorSettings `json:"mirrors"`
+	// options and repositories that nompac writes to pacconfig
+	Pacman_conf PacmanConfSettings `json:"pacman_conf"`
+	// files in /etc that are installed from the config repository by target path
+	Files map[string]ManagedFile `json:"files"`
+	// program that merges .pacnew and .pacsave files, e.g. "nvim -d"
+	Diffprog string `json:"diffprog"`
+	// base URL of the AUR, e.g. for a local mirror
+	Aur_url string `json:"aur_url"`
+	// maximum size of the source cache in MiB, the least recently used sources are removed first. 0 is unlimited
+	Source_cache_size int `json:"source_cache_size"`
+	// packages of a split PKGBUILD that are published in the local repository, all if the pkgbase is missing
+	Split_packages map[string][]string `json:"split_packages"`
+	// system package manager, "pacman" (default) or "zypper"
+	Package_manager string `json:"package_manager"`
+	// full path to the db.tar.zst-file of the local repository, Local_repo only holds the file name
+	Local_repo_path string `json:"-"`
+	// implementation of package_manager
+	Manager PackageManager `json:"-"`
+	// runs the commands that change the system, only prints them in dry runs
+	Runner CommandRunner `json:"-"`
 }
 
 // read current package version from repository
@@ -77,7 +133,7 @@ func get_current_version_from_repo(package_name string) string {
 	// Check for statuscode to ensure that the body contains a valid packagebuild
 	if response.StatusCode != http.StatusOK {
 		fmt.Printf("Failed to fetch PKGBUILD file: %d\n", response.StatusCode)
-		return "HTTP-Status-Code: " + string(response.StatusCode)
+		return "HTTP-Status-Code: " + strconv.Itoa(response.StatusCode)
 	}
 
 	// convert io.Reader to []byte
@@ -103,57 +159,125 @@ func get_version_from_overlay(config Config, packagename string) string {
 
 // Extract version from pkgbuild-file that was given as string in file_contents
 func get_version_from_pkgbuild(file_contents string) string {
+	pkgbuild := parse_pkgbuild(file_contents)
 
-	pkgver := ""
-	pkgrel := ""
-
-	for _, line := range strings.Split(file_contents, "\n") {
-		if strings.HasPrefix(line, "pkgver=") {
-			pkgver = strings.Split(line, "=")[1]
-		}
-		if strings.HasPrefix(line, "pkgrel=") {
-			pkgrel = strings.Split(line, "=")[1]
-		}
+	version := fmt.Sprintf("%s-%s", pkgbuild.value("pkgver"), pkgbuild.value("pkgrel"))
+	if epoch := pkgbuild.value("epoch"); epoch != "" && epoch != "0" {
+		version = epoch + ":" + version
 	}
-	return fmt.Sprintf("%s-%s", pkgver, pkgrel)
+	return version
 }
 
-// fetch the tarball from arch online repository.
-// parameters: package_name, package_version, file_path
-func get_current_tarball_from_repo(package_name string, package_version string, file_path string) {
+// URL of the tarball of the packaging files in the arch online repository.
+// parameters: package_name, package_version
+func upstream_tarball_url(package_name string, package_version string) string {
 	// URL of the tar.gz file in GitLab
-	url := fmt.Sprintf("https://gitlab.archlinux.org/archlinux/packaging/packages/%s/-/archive/%s/%s-%s.tar.gz", package_name, package_version, package_name, package_version)
+	return fmt.Sprintf("https://gitlab.archlinux.org/archlinux/packaging/packages/%s/-/archive/%s/%s-%s.tar.gz", package_name, package_version, package_name, package_version)
+}
 
-	// Create the file
-	out, err := os.Create(file_path)
-	if err != nil {
-		fmt.Printf("Failed to create file: %v\n", err)
-		return
-	}
-	defer out.Close()
+// downloads a tar.gz file to file_path. A truncated or damaged archive is refused
+func download_tarball(url string, file_path string) error {
+	return download_file(url, file_path, func(temp_file string) error {
+		// a truncated archive without Content-Length is detected by reading it completely
+		_, err := archive_hash(temp_file)
+		return err
+	})
+}
+
+// returned by download_file if the server doesn't have the file
+var not_found_error = errors.New("404 not found")
+
+// downloads a file to a temporary file that is only renamed to file_path once it is complete and check
+// accepted it, so an interrupted download never replaces a cached file.
+func download_file(url string, file_path string, check func(temp_file string) error) error {
+	name := filepath.Base(file_path)
 
-	// Fetch the tar.gz file
+	// Fetch the file
 	resp, err := http.Get(url)
 	if err != nil {
-		fmt.Printf("Failed to fetch tar.gz file: %v\n", err)
-		return
+		return fmt.Errorf("failed to fetch %s: %w", name, err)
 	}
 	defer resp.Body.Close()
 
 	// Check if the request was successful
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("failed to fetch %s: %w", name, not_found_error)
+	}
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Failed to fetch tar.gz file: %d\n", resp.StatusCode)
-		return
+		return fmt.Errorf("failed to fetch %s: %d", name, resp.StatusCode)
+	}
+
+	// Create the temporary file next to the target so that the rename doesn't cross file systems
+	out, err := os.CreateTemp(filepath.Dir(file_path), name+".part-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
 	}
+	defer os.Remove(out.Name())
 
 	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	written, err := io.Copy(out, resp.Body)
+	if err == nil {
+		err = out.Sync()
+	}
+	if close_err := out.Close(); err == nil {
+		err = close_err
+	}
 	if err != nil {
-		fmt.Printf("Failed to write tar.gz file: %v\n", err)
-		return
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return fmt.Errorf("download of %s is truncated: got %d of %d bytes", name, written, resp.ContentLength)
 	}
 
-	fmt.Printf("Successfully downloaded %s-%s.tar.gz\n", package_name, package_version)
+	if check != nil {
+		if err := check(out.Name()); err != nil {
+			return fmt.Errorf("downloaded %s is damaged: %w", name, err)
+		}
+	}
+	if err := os.Rename(out.Name(), file_path); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", name, err)
+	}
+
+	fmt.Printf("Successfully downloaded %s\n", name)
+	return nil
+}
+
+// reads the whole tar.gz file and returns a sha256 hash of the names, modes and contents of its entries.
+// GitLab creates the archives on demand and their compression can change, so the contents are hashed
+// instead of the file. Fails if the archive is truncated or damaged
+func archive_hash(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return "", err
+	}
+	defer gzr.Close()
+
+	hash := sha256.New()
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s %c %o %d %s\n", header.Name, header.Typeflag, header.Mode, header.Size, header.Linkname)
+		if _, err := io.Copy(hash, tr); err != nil {
+			return "", err
+		}
+	}
+	// the gzip trailer contains a checksum that is only verified once the stream is read to the end
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // extract the downloaded tarball
@@ -210,126 +334,129 @@ func extract_tgz(filename, output_path string) error {
 	return nil
 }
 
-// takes PKGBUILD file and patchname and adds the patch to the file
-func modify_pkgbuild(file string, patch string, package_name string) {
-
-	block_state := "none"
-	prepare_block_exists := false
-	modified_content := ""
-
-	contents, err := os.ReadFile(file)
-
+// takes PKGBUILD file and patchname and adds the patch to the file.
+// The patch is appended to the source array together with a SKIP entry in every checksum array
+// (updpkgsums replaces it before the build) and applied at the end of prepare() in the source directory.
+// Running it twice for the same patch doesn't change the PKGBUILD.
+func modify_pkgbuild(file string, patch PatchSpec, package_name string) {
+	pkgbuild, err := read_pkgbuild(file)
 	if err != nil {
-		fmt.Printf("Couldn't open file: %s", err.Error())
+		fmt.Printf("Couldn't open file: %s\n", err.Error())
 		return
 	}
 
-	for _, line := range strings.Split(string(contents), "\n") {
-		if strings.HasPrefix(strings.TrimLeft(line, " "), "source") {
-			block_state = "source"
-		}
-		if strings.HasPrefix(strings.TrimLeft(line, " "), "prepare") {
-			prepare_block_exists = true
-			block_state = "prepare"
-		}
-		if block_state == "source" && strings.HasSuffix(strings.TrimRight(line, " "), ")") {
-			modified_content += fmt.Sprintf("    \"%s\"\n", patch)
-			block_state = "none"
-		}
-		if block_state == "prepare" && strings.HasSuffix(line, "}") {
-			modified_content += fmt.Sprintf("    patch -Np1 -i \"${srcdir}/%s\"\n", patch)
-			block_state = "none"
+	if !contains(pkgbuild.array("source"), patch.File) {
+		pkgbuild.append_array("source", patch.File)
+		for _, sums := range checksum_arrays {
+			if pkgbuild.variable(sums) != nil {
+				pkgbuild.append_array(sums, "SKIP")
+			}
 		}
-
-		modified_content += line + "\n"
 	}
 
-	// if no prepare block exists in the PKGBUILD, append the block with the patch command
-	if !prepare_block_exists {
-		modified_content += fmt.Sprintf("\nprepare() {\n    cd %s-\"${pkgver}\"\n    patch -Np1 -i \"${srcdir}/%s\"\n}\n", package_name, patch)
+	patch_command := patch.command("${srcdir}/" + patch.File)
+	if !pkgbuild.function_contains("prepare", patch_command) {
+		commands := patch_directory_commands(pkgbuild, filepath.Dir(file), package_name)
+		if patch.Dir != "" {
+			commands = append(commands, fmt.Sprintf("cd \"%s\"", patch.Dir))
+		}
+		pkgbuild.append_to_function("prepare", append(commands, patch_command))
 	}
 
-	err = os.WriteFile(file, []byte(modified_content), 0644)
+	err = pkgbuild.write(file)
 	if err != nil {
 		fmt.Printf("Couldn't write PKGBUILD-file: %s\n", file)
 	} else {
-		fmt.Println("Successfully applied patch " + patch)
+		fmt.Println("Successfully applied patch " + patch.File)
+	}
+}
 
+// returns the commands to change into the directory the patches are applied in.
+// prepare() starts in $srcdir, so the first cd of prepare() or build() leads to the sources.
+// If neither contains a cd, the directory the sources were extracted to is used
+func patch_directory_commands(pkgbuild *Pkgbuild, pkg_build_dir string, package_name string) []string {
+	for _, function := range []string{"prepare", "build"} {
+		if cd := pkgbuild.first_cd(function); cd != "" {
+			return []string{"cd \"$srcdir\"", cd}
+		}
 	}
+	source_dir := filepath.Base(find_source_dir(pkg_build_dir, package_name))
+	return []string{fmt.Sprintf("cd \"$srcdir/%s\"", source_dir)}
 }
 
-// funtion takes the configuration, a vector of packages, the package name and the package version
-// patches should be applied and the path to the PKBBUILD file.
+// funtion takes the configuration, a vector of packages, the package name and the working directory
+// with the PKGBUILD file the patches should be applied to.
 // Then the function modifies the PKGBUILD file.
-func applyPatches(config Config, patches []string, packagename string, packageversion string) {
+func applyPatches(config Config, patches []PatchSpec, packagename string, pkg_build_dir string) {
 	for _, patch := range patches {
-		fmt.Println("Applying patch " + patch)
-		pkg_build_dir := filepath.Join(config.Build_dir, "src", fmt.Sprintf("%s-%s", packagename, packageversion))
+		fmt.Println("Applying patch " + patch.File)
 		copyFile(
-			filepath.Join(config.Patch_dir, packagename, patch),
-			filepath.Join(pkg_build_dir, patch),
+			filepath.Join(config.Patch_dir, packagename, patch.File),
+			filepath.Join(pkg_build_dir, patch.File),
 		)
 		modify_pkgbuild(filepath.Join(pkg_build_dir, "PKGBUILD"), patch, packagename)
 	}
 }
 
-func buildPackage(pkg_build_dir string) {
+// builds the package in pkg_build_dir and returns the package files that makepkg created.
+// The packages are written to a separate PKGDEST directory per build so that only the files of this run are used
+func buildPackage(config Config, packagename string, pkg_build_dir string) ([]string, error) {
 	fmt.Println("Building package in: ", pkg_build_dir)
-	commands := "pushd " + pkg_build_dir +
-		"; updpkgsums" +
-		"; makepkg -cCsr --skippgpcheck" +
-		"; popd"
-	execCmd(commands)
-}
-
-// takes config struct and packagename and updates the repository so that a build package is
-// copied to the local repository directory and added to the directory
-func update_repository(config Config, local_repo_dir string, packagename string) {
-	files, _ := filepath.Glob(filepath.Join(config.Build_dir, "src", packagename, "**", "*.pkg.tar.zst"))
+	if err := import_pgp_keys(config, packagename, pkg_build_dir); err != nil {
+		return nil, err
+	}
+	pkgdest := pkgdest_dir(config, filepath.Base(filepath.Clean(pkg_build_dir)))
+	os.RemoveAll(pkgdest)
+	os.MkdirAll(pkgdest, os.FileMode(0777))
+
+	// downloaded sources are kept in the shared source cache so that rebuilds don't fetch them again
+	srcdest := prepare_srcdest(config, packagename)
+	commands := "cd " + pkg_build_dir +
+		" && export SRCDEST=" + srcdest +
+		" && updpkgsums" +
+		" && PKGDEST=" + pkgdest + " makepkg -cCsr" + makepkg_pgp_flags(config, packagename)
+	err := execCmd(commands)
+	store_sources(config, srcdest)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, entry_result := range files {
-		copyFile(
-			entry_result,
-			filepath.Join(local_repo_dir, filepath.Base(entry_result)),
-		)
-		command := fmt.Sprintf(
-			"repo-add %s/nompaz.db.tar.zst %s/%s",
-			local_repo_dir,
-			local_repo_dir,
-			filepath.Base(entry_result),
-		)
-		execCmd(command)
+	// makepkg --packagelist prints the paths of all packages the PKGBUILD produces
+	output, err := exec.Command("bash", "-c", "cd "+pkg_build_dir+" && PKGDEST="+pkgdest+" makepkg --packagelist").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the package list: %w", err)
 	}
-}
 
-// cleans the build directory
-func cleanup(config Config) {
-	command := fmt.Sprintf("rm -r %s/src", config.Build_dir)
-	execCmd(command)
+	var package_files []string
+	for _, package_file := range strings.Fields(string(output)) {
+		if _, err := os.Stat(package_file); err == nil {
+			package_files = append(package_files, package_file)
+		}
+	}
+	if len(package_files) == 0 {
+		return nil, fmt.Errorf("makepkg didn't create any package in %s", pkgdest)
+	}
+	return package_files, nil
 }
 
-// takes the package name and returns version-revision of the installed package
-func get_installed_version(packagename string) string {
-	// Construct the command
-	command := fmt.Sprintf("pacman -Q | grep \"\\<%s\\>\" | cut -d' ' -f 2", packagename)
-	cmd := exec.Command("bash", "-c", command)
-
-	// Run the command and capture the output
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error while reading package version of ", packagename, err)
-	}
+// returns the names of the packages from package_files that are published in the local repository.
+// For split packages, split_packages in the config can restrict the published packages of a pkgbase
+func publish_packages(config Config, packagename string, package_files []string) []string {
+	selected, restricted := config.Split_packages[packagename]
 
-	// Save the output to a variable
-	output := out.String()
-	if len(output) > 0 {
-		return output
-	} else {
-		fmt.Println("No version found for package ", packagename)
-		return ""
+	var published []string
+	for _, package_file := range package_files {
+		match := package_file_regex.FindStringSubmatch(filepath.Base(package_file))
+		if match == nil {
+			continue
+		}
+		if restricted && !contains(selected, match[1]) {
+			fmt.Println("Not publishing " + filepath.Base(package_file))
+			continue
+		}
+		published = append(published, package_file)
 	}
+	return published
 }
 
 // Replace a row in filename containing the pattern with replacement.
@@ -351,7 +478,7 @@ func modify_file(filename string, pattern string, replacement string, append_if_
 
 	re, _ := regexp.Compile(pattern)
 	pattern_found, _ := regexp.MatchString(pattern, file_content)
-	
+
 	if pattern_found {
 		// replace the pattern
 		file_content = re.ReplaceAllString(file_content, replacement)
@@ -372,7 +499,7 @@ func modify_file(filename string, pattern string, replacement string, append_if_
 
 	_, err = file.WriteString(file_content)
 	if err != nil {
-		fmt.Println("Error writing file %s: %e", filename, err)
+		fmt.Printf("Error writing file %s: %s\n", filename, err)
 		file.Close()
 	}
 }
@@ -398,6 +525,18 @@ func parse_config(file_path string, args Args) Config {
 		panic(err)
 	}
 
+	// commands that change the system are only printed in dry runs
+	var runner CommandRunner = shell_runner{}
+	if args.dry_run {
+		runner = &dry_run_runner{}
+	}
+	configs.Runner = runner
+	configs.Manager, err = new_package_manager(configs.Package_manager, runner)
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		os.Exit(2)
+	}
+
 	// use pacconfig from args if available
 	if args.pacconfig != "none" {
 		configs.Pacconfig = args.pacconfig
@@ -414,15 +553,34 @@ func parse_config(file_path string, args Args) Config {
 	// if overlay-dir starts with ~ or $HOME, parse the directory
 	configs.Mirrorlist = resolve_home(configs.Mirrorlist)
 
+	configs.Pgp_keyring = resolve_home(configs.Pgp_keyring)
+
+	// sources of managed files are relative to the config file
+	for target, file := range configs.Files {
+		file.Source = resolve_home(file.Source)
+		if !filepath.IsAbs(file.Source) {
+			file.Source = filepath.Join(filepath.Dir(file_path), file.Source)
+		}
+		configs.Files[target] = file
+	}
+
+	// nompac keeps data between runs (e.g. the upstream files of the last build) in the state directory
+	if configs.State_dir == "" {
+		configs.State_dir = "~/.local/state/nompac"
+	}
+	configs.State_dir = resolve_home(configs.State_dir)
+
 	if strings.HasSuffix(strings.TrimRight(configs.Local_repo, " "), ".db.tar.zst") {
 		configs.Local_repo = resolve_home(configs.Local_repo)
+		configs.Local_repo_path = configs.Local_repo
 		// does the file exist?
-		_, err = os.Stat(configs.Local_repo)
-		if err != nil {
+		if !configs.Manager.local_repo_exists(configs) {
 			//initiate, if anything other the no or n is defined
 			if args.initiate != "no" && args.initiate != "n" {
 				fmt.Println("Repository file doesn't exist. It will be created.")
-				initiate_repo(configs)
+				if err := configs.Manager.init_local_repo(configs); err != nil {
+					fmt.Println(Red + "Couldn't create the local repository: " + err.Error() + Reset)
+				}
 				configs.Local_repo = filepath.Base(configs.Local_repo)
 
 			} else {
@@ -438,6 +596,25 @@ func parse_config(file_path string, args Args) Config {
 		fmt.Println(Red + "No db.tar.zst-file for local repository specified -> no local builds are possible" + Reset)
 	}
 
+	// makepkg only accepts pkgrel in the form integer[.integer]
+	if configs.Local_suffix != "none" && strings.Trim(configs.Local_suffix, "0123456789") != "" {
+		fmt.Println(Red + "local_suffix must only contain digits since makepkg only accepts pkgrel in the form integer[.integer]. Using the default." + Reset)
+		configs.Local_suffix = ""
+	}
+
+	if configs.Archive_url == "" {
+		configs.Archive_url = default_archive_url
+	}
+
+	if configs.Aur_url == "" {
+		configs.Aur_url = default_aur_url
+	}
+
+	// keep the current and the previous version of each package for rollbacks by default
+	if configs.Repo_keep <= 0 {
+		configs.Repo_keep = 2
+	}
+
 	return configs
 }
 
@@ -453,53 +630,22 @@ func resolve_home(path string) string {
 	return path
 }
 
-// initiate nompac.
-// Takes config struct
-// Creates local repo according to the defined local_repo config option
-func initiate_repo(config Config) {
-	local_repo_file := filepath.Base(config.Local_repo)
-	execCmd("repo-add " + local_repo_file)
-}
-
-// initiate nompac.
-// Takes config struct
-// Updates pacman.conf with configured mirrorlist and adds local repo
-func initiate_pacmanconf(config Config) {
-	// change mirrorlist to the one configured
-	modify_file(config.Pacconfig, "Include.*mirrorlist", "Include = "+config.Mirrorlist, false)
-
-	// add local repository
-	if config.Local_repo != "none" {
-		contents_bytes, err := os.ReadFile(config.Pacconfig)
+// copies the directory src recursively to dst
+func copy_dir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
 		if err != nil {
-			fmt.Println("Couldn't read pacconfig %s: %e", config.Pacconfig, err)
-		}
-		file_contents := string(contents_bytes)
-		var modified_content string
-		already_inserted := false
-		for _, line := range strings.Split(file_contents, "\n") {
-			if !already_inserted &&
-				(strings.HasSuffix(line, "[core-testing]") ||
-					strings.HasSuffix(line, "[core]") ||
-					strings.HasSuffix(line, "[extra-testing]") ||
-					strings.HasSuffix(line, "[extra]") ||
-					strings.HasSuffix(line, "[multilib]")) {
-				modified_content +=
-					"[nomispaz]\n" +
-						"Siglevel = Optional TrustAll\n" +
-						"Server = file://%s" + config.Local_repo + "\n\n" +
-						line + "\n"
-
-				already_inserted = true
-			} else {
-				modified_content += line + "\n"
-			}
+			return err
 		}
-		err = os.WriteFile(config.Pacconfig, []byte(modified_content), 0644)
+		relative, err := filepath.Rel(src, path)
 		if err != nil {
-			fmt.Printf("Couldn't write pacconfig-file %s: %e\n", config.Pacconfig, err)
+			return err
 		}
-	}
+		target := filepath.Join(dst, relative)
+		if entry.IsDir() {
+			return os.MkdirAll(target, os.FileMode(0777))
+		}
+		return copyFile(path, target)
+	})
 }
 
 func copyFile(src string, dst string) error {
@@ -533,17 +679,17 @@ func copyFile(src string, dst string) error {
 }
 
 // TODO rewrite with async
-func execCmd(command string) {
+func execCmd(command string) error {
 	cmd := exec.Command("bash", "-c", command)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	_ = cmd.Run() // add error checking
+	return cmd.Run()
 }
 
 func parse_args() Args {
 
-	snapshot := flag.String("snapshot", "none", "Defines the date of the Arch-repository snapshot that should be used. Always enter in the format YYYY_MM_DD. If no date is entered, no update will be performed.")
+	snapshot := flag.String("snapshot", "none", "Defines the date of the Arch-repository snapshot that should be used. Always enter in the format YYYY_MM_DD, rolling updates to the current state of the mirrors. Without a snapshot here or in the config file, no update will be performed.")
 
 	pacconfig := flag.String("pacconfig", "none", "Provides the pacconfig-file")
 
@@ -553,19 +699,53 @@ func parse_args() Args {
 
 	initiate := flag.String("initiate", "no", "Set to yes if the pacconfig file and the local repository file should be generated in this run.")
 
+	accept := flag.Bool("accept", false, "Accept changes that require a review (e.g. changed upstream PKGBUILDs) in non-interactive runs.")
+
+	dry_run := flag.Bool("dry-run", false, "Print the commands that install, remove or upgrade packages or change the local repository instead of running them.")
+
 	flag.Parse()
-	
+
 	args := Args{
-		snapshot: *snapshot,
-		pacconfig: *pacconfig,
-		config: *config,
+		snapshot:       *snapshot,
+		pacconfig:      *pacconfig,
+		config:         *config,
 		package_groups: *package_groups,
-		initiate: *initiate,
+		initiate:       *initiate,
+		accept:         *accept,
+		dry_run:        *dry_run,
+		command:        flag.Args(),
 	}
 
 	return args
 }
 
+// dispatches the subcommand given after the flags
+func run_command(configs Config, args Args) {
+	switch args.command[0] {
+	case "repo":
+		repo_command(configs, args.command[1:])
+	case "patch":
+		patch_command(configs, args.command[1:])
+	case "status":
+		status_command(configs)
+	case "clean":
+		clean_command(configs, args.command[1:])
+	case "overlay":
+		overlay_command(configs, args.command[1:])
+	default:
+		fmt.Println(Red + "Unknown command: " + args.command[0] + Reset)
+		os.Exit(2)
+	}
+}
+
+// returns the packages from the official repositories that should be patched together with their patches
+func patched_packages(config Config) Patches {
+	if len(config.Patches) == 0 {
+		return Patches{}
+	}
+	return config.Patches[0]
+}
+
 func contains(slice []string, str string) bool {
 	for _, item := range slice {
 		if item == str {
@@ -575,26 +755,13 @@ func contains(slice []string, str string) bool {
 	return false
 }
 
-func collect_package_lists(configs Config, args Args) ([]string, []string) {
+// returns the explicitly installed packages that aren't declared in the selected groups
+// and the declared packages that aren't installed explicitly
+func collect_package_lists(configs Config, package_groups []string) ([]string, []string) {
 	// collect packages that are installed explicitely
-	var package_list_installed []string
-
-	command := "pacman -Qe | cut -d' ' -f 1"
-	cmd, err := exec.Command("bash", "-c", command).Output()
-
+	package_list_installed, err := configs.Manager.query_explicit()
 	if err != nil {
-		fmt.Println(Red + "Couldn't get list of installed packages: err" + Reset)
-	}
-
-	package_list_installed = strings.Fields(string(cmd))
-
-	// use package group from args if available, otherwise from config-file
-	var package_groups []string
-
-	if args.package_groups != "none" {
-		package_groups = strings.Split(args.package_groups, ",")
-	} else {
-		package_groups = strings.Split(configs.Packagegroups, ",")
+		fmt.Println(Red + err.Error() + Reset)
 	}
 
 	// create package list of packages that should be installed explicitely
@@ -602,7 +769,7 @@ func collect_package_lists(configs Config, args Args) ([]string, []string) {
 	var package_list []string
 
 	for group, packagelist := range configs.Packages[0] {
-		if strings.Contains(package_groups[0], group) || strings.Contains(package_groups[0], "all") {
+		if group_selected(package_groups, group) {
 			for _, pkg := range packagelist {
 				package_list = append(package_list, strings.ToLower(pkg))
 			}
@@ -637,21 +804,46 @@ func main() {
 	// define and read command line arguments
 	args := parse_args()
 
+	// capture writes a new config and runs without one
+	if len(args.command) > 0 && args.command[0] == "capture" {
+		capture_command(args.command[1:])
+		return
+	}
+
 	// read JSON configuration file for nompac
 	configs := parse_config(resolve_home(args.config), args)
 
+	// subcommands like "nompac repo gc" only perform their task and don't run an update
+	if len(args.command) > 0 {
+		run_command(configs, args)
+		return
+	}
+
 	// initiate pacman.conf if required
 	if args.initiate != "no" && args.initiate != "n" {
-		initiate_pacmanconf(configs)
+		if err := configs.Manager.configure_repos(configs); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+		}
+	} else if configs.Manager.name() == "pacman" && pacman_conf_managed(configs) {
+		// the managed settings are written in every run, the file only changes if the config changed
+		if err := write_pacman_conf(configs); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+		}
 	}
 
-	var date []string
-
 	// if a snapshot was defined in the arguments, replace the one from the config file
+	snapshot := configs.Snapshot
 	if args.snapshot != "none" {
-		date = strings.Split(args.snapshot, "_")
-	} else {
-		date = strings.Split(configs.Snapshot, "_")
+		snapshot = args.snapshot
+	}
+	// an invalid snapshot is reported before the builds, the update would fail after them otherwise
+	var date []string
+	if snapshot != "" {
+		var err error
+		if date, err = snapshot_date(snapshot); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			os.Exit(2)
+		}
 	}
 
 	fmt.Println(Blue + "Used settings:" + Reset)
@@ -660,110 +852,48 @@ func main() {
 	fmt.Println("Patch directory: " + configs.Patch_dir)
 	fmt.Println("Overlay directory: " + configs.Overlay_dir)
 	fmt.Println("pacman.conf location: " + configs.Pacconfig)
+	print_snapshots(configs, snapshot)
 
 	os.MkdirAll(configs.Build_dir, os.FileMode(0777))
 
-	packages_to_remove, packages_to_install := collect_package_lists(configs, args)
+	plan := build_plan(configs, args)
+	print_plan(plan)
 
 	//building custom packages and overlays
-	if configs.Local_repo != "none" {
-		fmt.Println(Blue + "\nBuilding patched upstream-packages" + Reset)
-
-		// create necessary directories
-		// build directory
-		os.MkdirAll(filepath.Join(configs.Build_dir, "src"), os.FileMode(0777))
-
-		// apply patches, build new package and update local repository
-		for pkg, patches := range configs.Patches[0] {
-			package_version_repo := get_current_version_from_repo(pkg)
-			package_version_installed := get_installed_version(pkg)
-
-			//only procede if the package was updated upstream
-			if strings.TrimSpace(package_version_installed) != strings.TrimSpace(package_version_repo) {
-				get_current_tarball_from_repo(pkg, package_version_repo, fmt.Sprintf("%s/%s-%s.tar.gz", configs.Build_dir, pkg, package_version_repo))
-
-				fmt.Printf("%s/%s-%s.tar.gz\n", configs.Build_dir, pkg, package_version_repo)
-
-				extract_tgz(fmt.Sprintf("%s/%s-%s.tar.gz", configs.Build_dir, pkg, package_version_repo), filepath.Join(configs.Build_dir, "src"))
-
-				applyPatches(configs, patches, pkg, package_version_repo)
-
-				buildPackage(fmt.Sprintf("%s/src/%s-%s/", configs.Build_dir, pkg, package_version_repo))
+	lock := read_lockfile(configs)
+	if !builds_supported(configs) {
+		fmt.Println(Yellow + "Building packages is only supported with pacman, skipping the builds." + Reset)
+	} else {
+		if configs.Local_repo != "none" {
+			fmt.Println(Blue + "\nBuilding patched upstream-packages" + Reset)
 
-				update_repository(configs, configs.Local_repo, pkg)
-			} else {
-				fmt.Println(Green + fmt.Sprintf("Package %s already up to date."+Reset, pkg))
+			// apply patches, build new package and update local repository
+			for pkg, patches := range upstream_packages(configs) {
+				build_upstream_package(configs, args, &lock, pkg, patches)
 			}
 		}
-	}
-	fmt.Println(Blue + "\nBuilding packages from overlays" + Reset)
-	for _, pkg := range configs.Overlays {
-		package_version_overlay := get_version_from_overlay(configs, pkg)
-		package_version_installed := get_installed_version(pkg)
-
-		if strings.TrimSpace(package_version_installed) != strings.TrimSpace(package_version_overlay) {
-			// copy necessary files from overlay to build directory
-			filepath.WalkDir(filepath.Join(configs.Overlay_dir, pkg), func(path string, entry os.DirEntry, err error) error {
-				if err != nil {
-					return err
-				}
-				// if entry is a file,continue
-				if !entry.IsDir() {
-					// create directory if it is missing
-					os.MkdirAll(filepath.Join(configs.Build_dir, "src", pkg), os.FileMode(0777))
-					copyFile(path, filepath.Join(configs.Build_dir, "src", pkg, entry.Name()))
-				}
-				fmt.Println(configs.Build_dir + "/src" + pkg)
-				return nil
-			})
-
-			// build the package
-			buildPackage(filepath.Join(configs.Build_dir, "src", pkg))
-			update_repository(configs, configs.Local_repo, pkg)
-			cleanup(configs)
-		} else {
-			fmt.Println(Green + "Package " + pkg + " already up to date" + Reset)
+		fmt.Println(Blue + "\nBuilding packages from overlays" + Reset)
+		generate_overlays(configs)
+		for _, pkg := range configs.Overlays {
+			if name, is_aur := aur_name(pkg); is_aur {
+				build_aur_packages(configs, args, &lock, name)
+				continue
+			}
+			build_overlay_package(configs, &lock, pkg)
+		}
+		if configs.Local_repo != "none" {
+			cherry_pick_packages(configs, &lock, snapshot)
 		}
 	}
 
-	// perform system update
-	if date[0] != "none" {
+	// perform system update, snapshot "none" updates to the current state of the mirrors (rolling mode)
+	if snapshot != "" {
 		// update snapshot that will be used for the update
-		modify_file(configs.Mirrorlist, ".*archive.archlinux.org.*", fmt.Sprintf("Server = https://archive.archlinux.org/repos/%s/%s/%s/$$repo/os/$$arch", date[0], date[1], date[2]), true)
-
-		// only perform if packages have to be removed
-		if len(packages_to_remove) > 0 {
-			fmt.Println(Red + "Removing the following packages since they don't exist in the config file:" + Reset)
-			var package_list string
-			for _, pkg := range packages_to_remove {
-				package_list += " " + pkg
-			}
-			// TODO: change to async
-			fmt.Println(package_list)
-			execCmd("sudo pacman -Rsc " + package_list)
-
+		if err := configs.Manager.set_snapshot(configs, date); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			os.Exit(1)
 		}
 
-		// only perform if packages have to be installed
-		if len(packages_to_install) > 0 {
-			fmt.Println(Blue + "Installing the following packages and starting update:" + Reset)
-			var package_list string
-			for _, pkg := range packages_to_install {
-				package_list += " " + pkg
-			}
-			//TODO: change to async
-			fmt.Println(package_list)
-			execCmd("sudo pacman -Syu --config " + configs.Pacconfig + " " + package_list)
-
-			// after running the update, check for changed config files
-			//TODO: run sudo DIFFPROG='nvim -d' pacdiff interactively
-		} else {
-			fmt.Println(Blue + "Starting system update.\n" + Reset)
-			//TODO: change to async
-			execCmd("sudo pacman -Syu --config " + configs.Pacconfig)
-			// after running the update, check for changed config files
-			//TODO: run sudo DIFFPROG='nvim -d' pacdiff interactively
-
-		}
+		apply_plan(configs, plan)
 	}
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// mirrors nompac writes to the mirrorlist
+type MirrorSettings struct {
+	// archive mirrors the snapshot date is rendered into, as URL template with {{.Year}}, {{.Month}} and {{.Day}}
+	// or as base URL like https://archive.archlinux.org/repos. Default is the Arch Linux Archive
+	Archive []string `json:"archive"`
+	// countries of the mirrorlist whose mirrors are enabled in rolling mode, e.g. ["Germany", "Worldwide"].
+	// Without countries, the enabled mirrors of the mirrorlist are kept
+	Countries []string `json:"countries"`
+	// protocols of the mirrors of the countries, default ["https"]
+	Protocols []string `json:"protocols"`
+	// mirrors that are used in front of the others in rolling mode
+	Servers []string `json:"servers"`
+}
+
+// line of the mirrorlist, Url is empty for lines that aren't mirrors
+type MirrorlistLine struct {
+	Raw     string
+	Url     string
+	Country string
+	Enabled bool
+	// mirror that nompac commented out for snapshot mode, it is enabled again in rolling mode
+	Snapshot_disabled bool
+}
+
+// first and last line of the mirrors that nompac writes to the top of the mirrorlist
+const mirrorlist_begin = "## nompac: managed mirrors, changes are overwritten"
+const mirrorlist_end = "## nompac: end of managed mirrors"
+
+// prefix of the mirrors that nompac commented out for snapshot mode
+const snapshot_disabled_prefix = "#[snapshot] "
+
+const default_archive_mirror = "https://archive.archlinux.org/repos/{{.Year}}/{{.Month}}/{{.Day}}/$repo/os/$arch"
+
+// matches enabled and commented out mirrors, e.g. "#Server = https://geo.mirror.pkgbuild.com/$repo/os/$arch"
+var mirror_regex = regexp.MustCompile(`^(#\[snapshot\] |#)?\s*Server\s*=\s*(\S+)`)
+
+// archive server that earlier versions of nompac wrote to the mirrorlist for the snapshot
+const old_archive_server = "https://archive.archlinux.org/repos/"
+
+// parses a mirrorlist, the mirrors managed by nompac are skipped. Enabled archive servers from earlier versions
+// of nompac are skipped as well since the archive mirrors are configured in mirrors.archive. Commented out archive
+// servers are kept as they are
+func parse_mirrorlist(contents string) []MirrorlistLine {
+	var lines []MirrorlistLine
+	country := ""
+	managed := false
+	for _, raw := range strings.Split(strings.TrimSuffix(contents, "\n"), "\n") {
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == mirrorlist_begin:
+			managed = true
+			continue
+		case line == mirrorlist_end:
+			managed = false
+			continue
+		case managed || line == "# Arch linux archive":
+			continue
+		case strings.HasPrefix(line, "## "):
+			country = strings.TrimSpace(strings.TrimPrefix(line, "## "))
+		}
+
+		entry := MirrorlistLine{Raw: raw}
+		match := mirror_regex.FindStringSubmatch(line)
+		switch {
+		case match != nil && strings.HasPrefix(match[2], old_archive_server) && match[1] == "":
+			continue
+		case match != nil && !strings.HasPrefix(match[2], old_archive_server):
+			entry.Url = match[2]
+			entry.Country = country
+			entry.Enabled = match[1] == ""
+			entry.Snapshot_disabled = match[1] == snapshot_disabled_prefix
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+// returns the archive mirrors with the snapshot date (year, month, day)
+func archive_mirrors(settings MirrorSettings, date []string) ([]string, error) {
+	mirrors := settings.Archive
+	if len(mirrors) == 0 {
+		mirrors = []string{default_archive_mirror}
+	}
+
+	var servers []string
+	for _, mirror := range mirrors {
+		if !strings.Contains(mirror, "{{") {
+			mirror = strings.TrimRight(mirror, "/") + "/{{.Year}}/{{.Month}}/{{.Day}}/$repo/os/$arch"
+		}
+		mirror_template, err := template.New("archive").Parse(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive mirror %s: %w", mirror, err)
+		}
+		var server strings.Builder
+		err = mirror_template.Execute(&server, struct{ Year, Month, Day string }{date[0], date[1], date[2]})
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive mirror %s: %w", mirror, err)
+		}
+		servers = append(servers, server.String())
+	}
+	return servers, nil
+}
+
+// returns true if the mirror is used in rolling mode
+func mirror_selected(settings MirrorSettings, line MirrorlistLine) bool {
+	if len(settings.Countries) == 0 {
+		return line.Enabled || line.Snapshot_disabled
+	}
+	protocols := settings.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{"https"}
+	}
+	protocol, _, _ := strings.Cut(line.Url, "://")
+	country_selected := false
+	for _, country := range settings.Countries {
+		if strings.EqualFold(country, line.Country) {
+			country_selected = true
+		}
+	}
+	return country_selected && contains(protocols, protocol)
+}
+
+// renders the mirrorlist for the snapshot date, nil is rolling mode. In snapshot mode only the archive mirrors
+// are enabled so that pacman can't fall back to mirrors with newer packages. Commented out mirrors are kept
+func render_mirrorlist(settings MirrorSettings, contents string, date []string) (string, error) {
+	var managed []string
+	if date != nil {
+		servers, err := archive_mirrors(settings, date)
+		if err != nil {
+			return "", err
+		}
+		managed = servers
+	} else {
+		managed = settings.Servers
+	}
+
+	var output strings.Builder
+	enabled := len(managed)
+	if len(managed) > 0 {
+		output.WriteString(mirrorlist_begin + "\n")
+		for _, server := range managed {
+			output.WriteString("Server = " + server + "\n")
+		}
+		output.WriteString(mirrorlist_end + "\n")
+	}
+
+	for _, line := range parse_mirrorlist(contents) {
+		raw := line.Raw
+		if line.Url != "" {
+			selected := mirror_selected(settings, line)
+			switch {
+			case date != nil && selected:
+				raw = snapshot_disabled_prefix + "Server = " + line.Url
+			case date == nil && selected:
+				if !line.Enabled {
+					raw = "Server = " + line.Url
+				}
+				enabled++
+			case line.Enabled || line.Snapshot_disabled:
+				raw = "#Server = " + line.Url
+			}
+		}
+		output.WriteString(raw + "\n")
+	}
+
+	if enabled == 0 {
+		return "", fmt.Errorf("no mirror is enabled, set mirrors.countries or mirrors.servers for rolling mode")
+	}
+	return output.String(), nil
+}
+
+// returns year, month and day of a snapshot in the format YYYY_MM_DD, nil for rolling mode ("none" or "rolling")
+func snapshot_date(snapshot string) ([]string, error) {
+	if snapshot == "none" || snapshot == "rolling" {
+		return nil, nil
+	}
+	if _, err := time.Parse("2006_01_02", snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s, use the format YYYY_MM_DD", snapshot)
+	}
+	return strings.Split(snapshot, "_"), nil
+}
+
+// returns the mirrorlist a repository includes, repositories with their own snapshot date have their own
+// mirrorlist next to the configured one, e.g. mirrorlist-multilib
+func repo_mirrorlist(config Config, repository string) string {
+	if _, found := config.Repo_snapshots[repository]; found {
+		return config.Mirrorlist + "-" + repository
+	}
+	return config.Mirrorlist
+}
+
+// returns the snapshot for the header, "rolling" for rolling mode
+func snapshot_label(snapshot string) string {
+	if snapshot == "none" {
+		return "rolling"
+	}
+	return snapshot
+}
+
+// prints the effective snapshot of every repository that uses a mirrorlist
+func print_snapshots(config Config, snapshot string) {
+	if snapshot == "" {
+		fmt.Println("Snapshot: not set, no update")
+		return
+	}
+	fmt.Println("Snapshot: " + snapshot_label(snapshot))
+	if config.Manager.name() != "pacman" {
+		return
+	}
+	repositories := snapshot_repositories(config)
+	for _, repository := range repositories {
+		if repo_snapshot, found := config.Repo_snapshots[repository]; found {
+			fmt.Printf("  %s: %s (own snapshot)\n", repository, snapshot_label(repo_snapshot))
+		} else {
+			fmt.Printf("  %s: %s\n", repository, snapshot_label(snapshot))
+		}
+	}
+	for _, repository := range sorted_keys(config.Repo_snapshots) {
+		if !contains(repositories, repository) {
+			fmt.Println(Yellow + "  " + repository + " has its own snapshot but isn't a repository of " + config.Pacconfig + Reset)
+		}
+	}
+}
+
+// writes the mirrors of the snapshot and the own snapshots of repositories to their mirrorlists
+func write_mirrorlists(config Config, date []string) error {
+	if err := write_mirrorlist(config, config.Mirrorlist, config.Mirrorlist, date); err != nil {
+		return err
+	}
+	return write_repo_mirrorlists(config)
+}
+
+// writes the mirrorlists of the repositories with their own snapshot. They don't depend on the snapshot
+// of the run and are written together with pacconfig, which includes them
+func write_repo_mirrorlists(config Config) error {
+	for _, repository := range sorted_keys(config.Repo_snapshots) {
+		repo_date, err := snapshot_date(config.Repo_snapshots[repository])
+		if err != nil {
+			return fmt.Errorf("snapshot of %s: %w", repository, err)
+		}
+		// the mirrors of the repository are the same as in the configured mirrorlist
+		if err := write_mirrorlist(config, repo_mirrorlist(config, repository), config.Mirrorlist, repo_date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes the mirrors of the snapshot date or of rolling mode (date nil) to the mirrorlist file.
+// The mirrors are taken from the source file, which is the file itself for the configured mirrorlist.
+// The file is only written if it changes
+func write_mirrorlist(config Config, file string, source string, date []string) error {
+	contents, err := os.ReadFile(source)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't read mirrorlist %s: %w", source, err)
+	}
+	rendered, err := render_mirrorlist(config.Mirrors, string(contents), date)
+	if err != nil {
+		return err
+	}
+	current, _ := os.ReadFile(file)
+	if rendered == string(current) {
+		return nil
+	}
+
+	description := "set the mirrors of " + file + " to rolling mode"
+	if date != nil {
+		description = "set the snapshot in " + file + " to " + strings.Join(date, "/")
+	}
+	return config.Runner.modify(description, func() error {
+		temp_file := file + ".tmp"
+		if err := os.WriteFile(temp_file, []byte(rendered), 0644); err != nil {
+			return fmt.Errorf("couldn't write mirrorlist %s: %w", file, err)
+		}
+		return os.Rename(temp_file, file)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestRenderMirrorlist(t *testing.T) {
+	mirrorlist := `## Germany
+Server = https://mirror.example.de/archlinux/$repo/os/$arch
+#Server = http://mirror.example.de/archlinux/$repo/os/$arch
+# Arch linux archive
+Server = https://archive.archlinux.org/repos/2024/01/02/$repo/os/$arch
+#Server = https://archive.archlinux.org/repos/2023/05/06/$repo/os/$arch
+`
+	tests := []struct {
+		name     string
+		settings MirrorSettings
+		date     []string
+		want     string
+	}{
+		{
+			name: "snapshot",
+			date: []string{"2024", "11", "20"},
+			want: `## nompac: managed mirrors, changes are overwritten
+Server = https://archive.archlinux.org/repos/2024/11/20/$repo/os/$arch
+## nompac: end of managed mirrors
+## Germany
+#[snapshot] Server = https://mirror.example.de/archlinux/$repo/os/$arch
+#Server = http://mirror.example.de/archlinux/$repo/os/$arch
+#Server = https://archive.archlinux.org/repos/2023/05/06/$repo/os/$arch
+`,
+		},
+		{
+			name: "rolling",
+			want: `## Germany
+Server = https://mirror.example.de/archlinux/$repo/os/$arch
+#Server = http://mirror.example.de/archlinux/$repo/os/$arch
+#Server = https://archive.archlinux.org/repos/2023/05/06/$repo/os/$arch
+`,
+		},
+		{
+			name:     "rolling with countries and servers",
+			settings: MirrorSettings{Countries: []string{"germany"}, Protocols: []string{"http"}, Servers: []string{"https://mirror.example.org/$repo/os/$arch"}},
+			want: `## nompac: managed mirrors, changes are overwritten
+Server = https://mirror.example.org/$repo/os/$arch
+## nompac: end of managed mirrors
+## Germany
+#Server = https://mirror.example.de/archlinux/$repo/os/$arch
+Server = http://mirror.example.de/archlinux/$repo/os/$arch
+#Server = https://archive.archlinux.org/repos/2023/05/06/$repo/os/$arch
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			once, err := render_mirrorlist(test.settings, mirrorlist, test.date)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if once != test.want {
+				t.Errorf("render_mirrorlist() =\n%s\nwant\n%s", once, test.want)
+			}
+			if twice, _ := render_mirrorlist(test.settings, once, test.date); twice != once {
+				t.Errorf("second render_mirrorlist() changed the mirrorlist:\n%s", twice)
+			}
+		})
+	}
+}
+
+func TestSnapshotDate(t *testing.T) {
+	tests := []struct {
+		snapshot string
+		want     []string
+		valid    bool
+	}{
+		{"2024_11_20", []string{"2024", "11", "20"}, true},
+		{"none", nil, true},
+		{"rolling", nil, true},
+		{"2024_13_01", nil, false},
+		{"2024-11-20", nil, false},
+		{"24_11_20", nil, false},
+	}
+
+	for _, test := range tests {
+		date, err := snapshot_date(test.snapshot)
+		if (err == nil) != test.valid || len(date) != len(test.want) {
+			t.Errorf("snapshot_date(%s) = %q, %v", test.snapshot, date, err)
+			continue
+		}
+		for i := range date {
+			if date[i] != test.want[i] {
+				t.Errorf("snapshot_date(%s) = %q, want %q", test.snapshot, date, test.want)
+			}
+		}
+	}
+}
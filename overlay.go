@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// where nompac looks for new upstream releases of an overlay. Exactly one of github, url or git is set
+type OverlaySource struct {
+	// GitHub repository in the form owner/repo
+	Github string `json:"github"`
+	// "releases" (default) uses the latest GitHub release, "tags" the newest tag
+	Use string `json:"use"`
+	// page that lists the versions, they are matched with regex
+	Url string `json:"url"`
+	// regular expression with one group for the version, e.g. "codelldb-([0-9.]+)\\.tar\\.gz"
+	Regex string `json:"regex"`
+	// git remote whose tags are the versions
+	Git string `json:"git"`
+	// prefix of the tags that isn't part of pkgver, e.g. "v"
+	Prefix string `json:"prefix"`
+}
+
+// versions have to start with a digit, tags like "nightly" are ignored
+var release_version_regex = regexp.MustCompile(`^[0-9][0-9A-Za-z._+]*$`)
+
+// handles "nompac overlay": outdated shows overlays and components with newer upstream releases,
+// bump updates an overlay and generate renders the PKGBUILDs of generated overlays
+func overlay_command(config Config, command []string) {
+	if len(command) == 0 {
+		fmt.Println(Red + "Missing overlay command. Available: outdated, bump, generate" + Reset)
+		os.Exit(2)
+	}
+
+	switch command[0] {
+	case "outdated":
+		overlays_ok := overlay_outdated(config)
+		if !components_outdated(config) || !overlays_ok {
+			os.Exit(1)
+		}
+	case "bump":
+		if len(command) < 2 || len(command) > 3 {
+			fmt.Println(Red + "Usage: nompac overlay bump <pkg> [version]" + Reset)
+			os.Exit(2)
+		}
+		version := ""
+		if len(command) == 3 {
+			version = command[2]
+		}
+		if err := overlay_bump(config, command[1], version); err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			os.Exit(1)
+		}
+	case "generate":
+		all_ok := true
+		if len(command) == 1 {
+			all_ok = generate_overlays(config)
+		}
+		for _, pkg := range command[1:] {
+			if _, ok := config.Generated_overlays[pkg]; !ok {
+				fmt.Println(Red + pkg + " isn't a generated overlay" + Reset)
+				all_ok = false
+			} else if err := generate_overlay(config, pkg); err != nil {
+				fmt.Println(Red + err.Error() + Reset)
+				all_ok = false
+			}
+		}
+		if !all_ok {
+			os.Exit(1)
+		}
+	default:
+		fmt.Println(Red + "Unknown overlay command: " + command[0] + Reset)
+		os.Exit(2)
+	}
+}
+
+// reports the overlays whose upstream source has a newer release than pkgver.
+// returns false if a source couldn't be checked
+func overlay_outdated(config Config) bool {
+	all_ok := true
+	for _, pkg := range sorted_keys(config.Overlay_sources) {
+		current, err := overlay_pkgver(config, pkg)
+		if err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			all_ok = false
+			continue
+		}
+		latest, err := latest_release(config.Overlay_sources[pkg])
+		if err != nil {
+			fmt.Printf(Red+"  %s: %s\n"+Reset, pkg, err)
+			all_ok = false
+			continue
+		}
+
+		if vercmp(latest, current) > 0 {
+			fmt.Printf(Yellow+"  %s: %s -> %s\n"+Reset, pkg, current, latest)
+		} else {
+			fmt.Printf(Green+"  %s: %s is up to date\n"+Reset, pkg, current)
+		}
+	}
+	return all_ok
+}
+
+// sets pkgver of an overlay to version (the latest release if empty), resets pkgrel to 1
+// and regenerates the checksums with updpkgsums
+func overlay_bump(config Config, pkg string, version string) error {
+	if version == "" {
+		source, ok := config.Overlay_sources[pkg]
+		if !ok {
+			return fmt.Errorf("no overlay source configured for %s, give the version explicitly", pkg)
+		}
+		latest, err := latest_release(source)
+		if err != nil {
+			return fmt.Errorf("couldn't determine the latest release of %s: %w", pkg, err)
+		}
+		version = latest
+	}
+	if !release_version_regex.MatchString(version) {
+		return fmt.Errorf("%s isn't a valid pkgver", version)
+	}
+
+	overlay_dir := filepath.Join(config.Overlay_dir, pkg)
+	file := filepath.Join(overlay_dir, "PKGBUILD")
+	pkgbuild, err := read_pkgbuild(file)
+	if err != nil {
+		return fmt.Errorf("couldn't read PKGBUILD of %s: %w", pkg, err)
+	}
+
+	current := pkgbuild.value("pkgver")
+	if current == version {
+		fmt.Println(Green + pkg + " is already at " + version + Reset)
+		return nil
+	}
+	fmt.Printf("Bumping %s from %s to %s\n", pkg, current, version)
+	pkgbuild.set_variable("pkgver", version)
+	pkgbuild.set_variable("pkgrel", "1")
+	if err := pkgbuild.write(file); err != nil {
+		return fmt.Errorf("couldn't write PKGBUILD of %s: %w", pkg, err)
+	}
+
+	// the new sources are downloaded to the source cache and reused by the build
+	srcdest := prepare_srcdest(config, pkg)
+	err = execCmd("cd " + overlay_dir + " && SRCDEST=" + srcdest + " updpkgsums")
+	store_sources(config, srcdest)
+	if err != nil {
+		return fmt.Errorf("couldn't update the checksums of %s: %w", pkg, err)
+	}
+	return nil
+}
+
+// returns pkgver of the PKGBUILD of an overlay
+func overlay_pkgver(config Config, pkg string) (string, error) {
+	pkgbuild, err := read_pkgbuild(filepath.Join(config.Overlay_dir, pkg, "PKGBUILD"))
+	if err != nil {
+		return "", fmt.Errorf("couldn't read PKGBUILD of %s: %w", pkg, err)
+	}
+	return pkgbuild.value("pkgver"), nil
+}
+
+// returns the newest version of an overlay source
+func latest_release(source OverlaySource) (string, error) {
+	var candidates []string
+	switch {
+	case source.Github != "" && (source.Use == "" || source.Use == "releases"):
+		var release struct {
+			Tag_name string `json:"tag_name"`
+		}
+		if err := get_json("https://api.github.com/repos/"+source.Github+"/releases/latest", &release); err != nil {
+			return "", err
+		}
+		candidates = []string{release.Tag_name}
+	case source.Github != "" && source.Use == "tags":
+		var tags []struct {
+			Name string `json:"name"`
+		}
+		if err := get_json("https://api.github.com/repos/"+source.Github+"/tags?per_page=100", &tags); err != nil {
+			return "", err
+		}
+		for _, tag := range tags {
+			candidates = append(candidates, tag.Name)
+		}
+	case source.Github != "":
+		return "", fmt.Errorf("unknown value of use: %s", source.Use)
+	case source.Url != "":
+		regex, err := regexp.Compile(source.Regex)
+		if err != nil || regex.NumSubexp() != 1 {
+			return "", fmt.Errorf("regex of %s needs exactly one group for the version", source.Url)
+		}
+		page, err := get_text(source.Url)
+		if err != nil {
+			return "", err
+		}
+		for _, match := range regex.FindAllStringSubmatch(page, -1) {
+			candidates = append(candidates, match[1])
+		}
+	case source.Git != "":
+		output, err := exec.Command("git", "ls-remote", "--tags", "--refs", source.Git).Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to list the tags of %s: %w", source.Git, err)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if _, ref, found := strings.Cut(line, "\t"); found {
+				candidates = append(candidates, strings.TrimPrefix(ref, "refs/tags/"))
+			}
+		}
+	default:
+		return "", fmt.Errorf("overlay source needs github, url or git")
+	}
+
+	latest := ""
+	for _, candidate := range candidates {
+		version := strings.TrimPrefix(candidate, source.Prefix)
+		if !release_version_regex.MatchString(version) {
+			continue
+		}
+		if latest == "" || vercmp(version, latest) > 0 {
+			latest = version
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no versions found")
+	}
+	return latest, nil
+}
+
+func get_text(url string) (string, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch %s: %d", url, response.StatusCode)
+	}
+	contents, err := io.ReadAll(response.Body)
+	return string(contents), err
+}
+
+func get_json(url string, value any) error {
+	contents, err := get_text(url)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(contents), value); err != nil {
+		return fmt.Errorf("failed to parse the response of %s: %w", url, err)
+	}
+	return nil
+}
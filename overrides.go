@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// declarative changes of the PKGBUILD of a package from the official repositories.
+// Values of variables and lines of functions are shell code and written as given
+type Override struct {
+	// variables that are replaced, e.g. {"pkgdesc": "\"wlroots with nvidia fixes\""}.
+	// pkgver and pkgrel can't be set since nompac manages the version of local builds
+	Set map[string]string `json:"set"`
+	// arrays that are replaced
+	Set_arrays map[string][]string `json:"set_arrays"`
+	// values that are appended to arrays, e.g. {"makedepends": ["glslang"]}
+	Append map[string][]string `json:"append"`
+	// lines inserted at the beginning of functions, e.g. {"build": ["export CFLAGS+=' -O3'"]}
+	Prepend_functions map[string][]string `json:"prepend_functions"`
+	// lines appended to the end of functions, e.g. {"prepare": ["sed -i 's/a/b/' meson.build"]}
+	Append_functions map[string][]string `json:"append_functions"`
+	// entries of the options array, an entry replaces the existing one with the same name, e.g. "!debug" replaces "debug"
+	Options []string `json:"options"`
+}
+
+// returns the packages from the official repositories that are rebuilt because they have patches or overrides
+func upstream_packages(config Config) Patches {
+	packages := Patches{}
+	for pkg, patches := range patched_packages(config) {
+		packages[pkg] = patches
+	}
+	for pkg := range config.Overrides {
+		if _, ok := packages[pkg]; !ok {
+			packages[pkg] = nil
+		}
+	}
+	return packages
+}
+
+// applies the override of the package to the PKGBUILD in pkg_build_dir
+func apply_overrides(config Config, packagename string, pkg_build_dir string) error {
+	override, ok := config.Overrides[packagename]
+	if !ok {
+		return nil
+	}
+
+	file := filepath.Join(pkg_build_dir, "PKGBUILD")
+	pkgbuild, err := read_pkgbuild(file)
+	if err != nil {
+		return fmt.Errorf("couldn't read PKGBUILD of %s: %w", packagename, err)
+	}
+
+	fmt.Println("Applying overrides of " + packagename)
+	if err := apply_override(pkgbuild, override); err != nil {
+		return fmt.Errorf("invalid override of %s: %w", packagename, err)
+	}
+
+	if err := pkgbuild.write(file); err != nil {
+		return fmt.Errorf("couldn't write PKGBUILD of %s: %w", packagename, err)
+	}
+	return nil
+}
+
+// changes the PKGBUILD model according to the override.
+// map entries are applied in sorted order so that the result doesn't change between runs
+func apply_override(pkgbuild *Pkgbuild, override Override) error {
+	// the version is taken from the snapshot and pkgrel is overwritten with the local release
+	for _, name := range []string{"pkgver", "pkgrel"} {
+		if _, ok := override.Set[name]; ok {
+			return fmt.Errorf("%s can't be overridden", name)
+		}
+	}
+
+	for _, name := range sorted_keys(override.Set) {
+		pkgbuild.set_variable(name, override.Set[name])
+	}
+	for _, name := range sorted_keys(override.Set_arrays) {
+		pkgbuild.set_array(name, override.Set_arrays[name])
+	}
+	for _, name := range sorted_keys(override.Append) {
+		var missing []string
+		for _, value := range override.Append[name] {
+			if !contains(pkgbuild.array(name), value) {
+				missing = append(missing, value)
+			}
+		}
+		if len(missing) > 0 {
+			pkgbuild.append_array(name, missing...)
+		}
+	}
+	for _, name := range sorted_keys(override.Prepend_functions) {
+		pkgbuild.prepend_to_function(name, override.Prepend_functions[name])
+	}
+	for _, name := range sorted_keys(override.Append_functions) {
+		pkgbuild.append_to_function(name, override.Append_functions[name])
+	}
+
+	if len(override.Options) > 0 {
+		options := pkgbuild.array("options")
+		for _, option := range override.Options {
+			name := strings.TrimPrefix(option, "!")
+			var merged []string
+			for _, existing := range options {
+				if strings.TrimPrefix(existing, "!") != name {
+					merged = append(merged, existing)
+				}
+			}
+			options = append(merged, option)
+		}
+		pkgbuild.set_array("options", options)
+	}
+	return nil
+}
+
+// returns the keys of a map in sorted order
+func sorted_keys[V any](values map[string]V) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
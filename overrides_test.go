@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestApplyOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		override Override
+		want     string
+	}{
+		{
+			name:     "set variables",
+			contents: "pkgname=foo\npkgver=1.0\npkgdesc='foo'\n",
+			override: Override{Set: map[string]string{"pkgdesc": "\"patched foo\"", "url": "https://example.org"}},
+			want:     "pkgname=foo\npkgver=1.0\npkgdesc=\"patched foo\"\nurl=https://example.org\n",
+		},
+		{
+			name:     "set arrays",
+			contents: "pkgname=foo\ncheckdepends=('check' 'valgrind')\ndepends=(glibc)\n",
+			override: Override{Set_arrays: map[string][]string{"checkdepends": {}, "depends": {"glibc", "zlib"}}},
+			want:     "pkgname=foo\ncheckdepends=()\ndepends=(\"glibc\" \"zlib\")\n",
+		},
+		{
+			name:     "append only missing values",
+			contents: "pkgname=foo\nmakedepends=('meson' 'ninja')\n",
+			override: Override{Append: map[string][]string{"makedepends": {"ninja", "glslang"}}},
+			want:     "pkgname=foo\nmakedepends=('meson' 'ninja' 'glslang')\n",
+		},
+		{
+			name:     "merge options",
+			contents: "pkgname=foo\noptions=('debug' '!strip' 'lto')\n",
+			override: Override{Options: []string{"!debug", "strip", "!lto"}},
+			want:     "pkgname=foo\noptions=(\"!debug\" \"strip\" \"!lto\")\n",
+		},
+		{
+			name:     "add options",
+			contents: "pkgname=foo\n",
+			override: Override{Options: []string{"!debug"}},
+			want:     "pkgname=foo\noptions=(\"!debug\")\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pkgbuild := parse_pkgbuild(test.contents)
+			if err := apply_override(pkgbuild, test.override); err != nil {
+				t.Fatal(err)
+			}
+			once := pkgbuild.String()
+			if once != test.want {
+				t.Errorf("apply_override() =\n%s\nwant\n%s", once, test.want)
+			}
+
+			// applying the override to the changed PKGBUILD doesn't change it again
+			if err := apply_override(pkgbuild, test.override); err != nil {
+				t.Fatal(err)
+			}
+			if twice := pkgbuild.String(); twice != once {
+				t.Errorf("second apply_override() changed the PKGBUILD:\n%s", twice)
+			}
+		})
+	}
+}
+
+func TestApplyOverrideFunctions(t *testing.T) {
+	contents := "pkgname=foo\n\nbuild() {\n  make\n}\n"
+	override := Override{
+		Prepend_functions: map[string][]string{"build": {"export CFLAGS+=' -O3'"}},
+		Append_functions:  map[string][]string{"prepare": {"sed -i 's/a/b/' meson.build"}},
+	}
+	want := "pkgname=foo\n\nprepare() {\n  sed -i 's/a/b/' meson.build\n}\n\nbuild() {\n  export CFLAGS+=' -O3'\n  make\n}\n"
+
+	pkgbuild := parse_pkgbuild(contents)
+	if err := apply_override(pkgbuild, override); err != nil {
+		t.Fatal(err)
+	}
+	if output := pkgbuild.String(); output != want {
+		t.Errorf("apply_override() =\n%s\nwant\n%s", output, want)
+	}
+}
+
+func TestApplyOverrideVersion(t *testing.T) {
+	for _, name := range []string{"pkgver", "pkgrel"} {
+		pkgbuild := parse_pkgbuild("pkgname=foo\npkgver=1.0\npkgrel=1\n")
+		if err := apply_override(pkgbuild, Override{Set: map[string]string{name: "2"}}); err == nil {
+			t.Errorf("apply_override() accepted an override of %s", name)
+		}
+		if output := pkgbuild.String(); output != "pkgname=foo\npkgver=1.0\npkgrel=1\n" {
+			t.Errorf("rejected override of %s changed the PKGBUILD:\n%s", name, output)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// system package manager nompac declares the installed packages with.
+// Building packages with makepkg is only supported with pacman, the other managers only install,
+// remove and upgrade packages and manage the local repository
+type PackageManager interface {
+	name() string
+	// returns version-release of an installed package, empty if it isn't installed
+	query_installed(packagename string) string
+	// returns the names of the explicitly installed packages
+	query_explicit() ([]string, error)
+	// installs packages from local package files, as_deps marks them as installed as dependency
+	install_local(package_files []string, as_deps bool) error
+	remove(packages []string) error
+	// upgrades the whole system to the configured snapshot and installs the given packages
+	upgrade(config Config, install []string) error
+	// points the package manager to the repository snapshot of the date (year, month, day), nil is rolling mode
+	set_snapshot(config Config, date []string) error
+	// adds the configured mirrors and the local repository to the configuration of the package manager
+	configure_repos(config Config) error
+	local_repo_exists(config Config) bool
+	init_local_repo(config Config) error
+	// copies package files to the local repository and adds them to its database
+	add_to_local_repo(config Config, package_files []string) error
+	remove_from_local_repo(config Config, packages []string) error
+}
+
+// runs the commands of the package managers. Commands that change the system go through run and modify,
+// queries that only read the system through output
+type CommandRunner interface {
+	run(command string) error
+	// runs a query and returns its standard output
+	output(command string) ([]byte, error)
+	// changes a file, description says what is changed
+	modify(description string, change func() error) error
+}
+
+// runs commands in bash with the terminal attached
+type shell_runner struct{}
+
+func (shell_runner) run(command string) error {
+	return execCmd(command)
+}
+
+func (shell_runner) output(command string) ([]byte, error) {
+	return exec.Command("bash", "-c", command).Output()
+}
+
+func (shell_runner) modify(description string, change func() error) error {
+	return change()
+}
+
+// prints commands instead of running them, used for -dry-run. Queries are still run since the plan depends on them
+type dry_run_runner struct{}
+
+func (runner *dry_run_runner) run(command string) error {
+	fmt.Println(Cyan + "[dry-run] " + command + Reset)
+	return nil
+}
+
+func (runner *dry_run_runner) output(command string) ([]byte, error) {
+	return shell_runner{}.output(command)
+}
+
+func (runner *dry_run_runner) modify(description string, change func() error) error {
+	return runner.run("# " + description)
+}
+
+// creates the package manager of the config, the runner executes the commands that change the system
+func new_package_manager(name string, runner CommandRunner) (PackageManager, error) {
+	switch name {
+	case "", "pacman":
+		return &pacman_manager{runner: runner}, nil
+	case "zypper":
+		return &zypper_manager{runner: runner}, nil
+	default:
+		return nil, fmt.Errorf("unknown package manager: %s", name)
+	}
+}
+
+// returns true if packages can be built into the local repository, which needs makepkg
+func builds_supported(config Config) bool {
+	return config.Manager.name() == "pacman"
+}
+
+// name of the local repository in the package manager, the file name of local_repo without .db.tar.zst
+func local_repo_name(config Config) string {
+	return strings.TrimSuffix(filepath.Base(config.Local_repo_path), ".db.tar.zst")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// records the commands of a package manager instead of running them and answers queries with canned outputs.
+// Queries without output fail like a query for a package that isn't installed
+type recording_runner struct {
+	commands []string
+	outputs  map[string]string
+}
+
+func (runner *recording_runner) run(command string) error {
+	runner.commands = append(runner.commands, command)
+	return nil
+}
+
+func (runner *recording_runner) output(command string) ([]byte, error) {
+	runner.commands = append(runner.commands, command)
+	output, found := runner.outputs[command]
+	if !found {
+		return nil, fmt.Errorf("exit status 1")
+	}
+	return []byte(output), nil
+}
+
+func (runner *recording_runner) modify(description string, change func() error) error {
+	runner.commands = append(runner.commands, "# "+description)
+	return nil
+}
+
+func check_commands(t *testing.T, runner *recording_runner, want []string) {
+	t.Helper()
+	if !reflect.DeepEqual(runner.commands, want) {
+		t.Errorf("commands =\n%q\nwant\n%q", runner.commands, want)
+	}
+}
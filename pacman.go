@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pacman with a local repository managed by repo-add
+type pacman_manager struct {
+	runner CommandRunner
+}
+
+func (manager *pacman_manager) name() string {
+	return "pacman"
+}
+
+// takes the package name and returns version-revision of the installed package
+func (manager *pacman_manager) query_installed(packagename string) string {
+	output, err := manager.runner.output("pacman -Q " + packagename)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 || fields[0] != packagename {
+		// pacman -Q also finds packages that provide the name
+		return ""
+	}
+	return fields[1]
+}
+
+func (manager *pacman_manager) query_explicit() ([]string, error) {
+	output, err := manager.runner.output("pacman -Qqe")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get list of installed packages: %w", err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+func (manager *pacman_manager) install_local(package_files []string, as_deps bool) error {
+	command := "sudo pacman -U --needed --noconfirm "
+	if as_deps {
+		command += "--asdeps "
+	}
+	return manager.runner.run(command + strings.Join(package_files, " "))
+}
+
+func (manager *pacman_manager) remove(packages []string) error {
+	return manager.runner.run("sudo pacman -Rsc " + strings.Join(packages, " "))
+}
+
+func (manager *pacman_manager) upgrade(config Config, install []string) error {
+	command := "sudo pacman -Syu --config " + config.Pacconfig
+	if len(install) > 0 {
+		command += " " + strings.Join(install, " ")
+	}
+	return manager.runner.run(command)
+}
+
+// update snapshot that will be used for the update, date nil switches to rolling mode.
+// Repositories with their own snapshot date get their own mirrorlist
+func (manager *pacman_manager) set_snapshot(config Config, date []string) error {
+	return write_mirrorlists(config, date)
+}
+
+// Updates pacman.conf with configured mirrorlist, the local repo and the managed options and repositories
+func (manager *pacman_manager) configure_repos(config Config) error {
+	if config.Local_repo != "none" && config.Sign_key != "" {
+		manager.runner.modify("add signing key "+config.Sign_key+" to the pacman keyring", func() error {
+			trust_sign_key(config)
+			return nil
+		})
+	}
+	return write_pacman_conf(config)
+}
+
+func (manager *pacman_manager) local_repo_exists(config Config) bool {
+	_, err := os.Stat(config.Local_repo_path)
+	return err == nil
+}
+
+// Creates local repo according to the defined local_repo config option
+func (manager *pacman_manager) init_local_repo(config Config) error {
+	os.MkdirAll(filepath.Dir(config.Local_repo_path), os.FileMode(0777))
+	return manager.runner.run("repo-add " + repo_add_sign_flags(config) + config.Local_repo_path)
+}
+
+// the package files of a build are copied to the local repository directory and added to the database
+func (manager *pacman_manager) add_to_local_repo(config Config, package_files []string) error {
+	local_repo_dir := filepath.Dir(config.Local_repo_path)
+	for _, entry_result := range package_files {
+		package_file := filepath.Join(local_repo_dir, filepath.Base(entry_result))
+		err := manager.runner.modify("copy "+entry_result+" to "+local_repo_dir, func() error {
+			if err := copyFile(entry_result, package_file); err != nil {
+				return err
+			}
+			// sign the package before it is added so that repo-add records the signature in the database
+			if config.Sign_key != "" {
+				return sign_file(config, package_file)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		command := fmt.Sprintf("repo-add %s%s %s", repo_add_sign_flags(config), config.Local_repo_path, package_file)
+		if err := manager.runner.run(command); err != nil {
+			return fmt.Errorf("failed to add %s to the local repository: %w", filepath.Base(package_file), err)
+		}
+	}
+	return nil
+}
+
+func (manager *pacman_manager) remove_from_local_repo(config Config, packages []string) error {
+	return manager.runner.run(fmt.Sprintf("repo-remove %s%s %s", repo_add_sign_flags(config), config.Local_repo_path, strings.Join(packages, " ")))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPacmanQueryInstalled(t *testing.T) {
+	tests := []struct {
+		name   string
+		output map[string]string
+		want   string
+	}{
+		{"installed", map[string]string{"pacman -Q wlroots0.17": "wlroots0.17 0.17.4-2.1\n"}, "0.17.4-2.1"},
+		{"provided by another package", map[string]string{"pacman -Q wlroots0.17": "wlroots 0.18.2-1\n"}, ""},
+		{"not installed", nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &recording_runner{outputs: test.output}
+			manager := &pacman_manager{runner: runner}
+			if version := manager.query_installed("wlroots0.17"); version != test.want {
+				t.Errorf("query_installed() = %q, want %q", version, test.want)
+			}
+			check_commands(t, runner, []string{"pacman -Q wlroots0.17"})
+		})
+	}
+}
+
+func TestPacmanQueryExplicit(t *testing.T) {
+	runner := &recording_runner{outputs: map[string]string{"pacman -Qqe": "base\nlinux\nvim\n"}}
+	manager := &pacman_manager{runner: runner}
+
+	packages, err := manager.query_explicit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"base", "linux", "vim"}; !reflect.DeepEqual(packages, want) {
+		t.Errorf("query_explicit() = %q, want %q", packages, want)
+	}
+	check_commands(t, runner, []string{"pacman -Qqe"})
+}
+
+func TestPacmanCommands(t *testing.T) {
+	repo_dir := t.TempDir()
+	config := Config{
+		Pacconfig:       "/etc/nompac/pacman.conf",
+		Local_repo:      "nomispaz",
+		Local_repo_path: filepath.Join(repo_dir, "nomispaz.db.tar.zst"),
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		action func(manager *pacman_manager, config Config) error
+		want   []string
+	}{
+		{
+			name: "install as dependency",
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.install_local([]string{"a-1-1-x86_64.pkg.tar.zst", "b-1-1-any.pkg.tar.zst"}, true)
+			},
+			want: []string{"sudo pacman -U --needed --noconfirm --asdeps a-1-1-x86_64.pkg.tar.zst b-1-1-any.pkg.tar.zst"},
+		},
+		{
+			name: "install",
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.install_local([]string{"a-1-1-x86_64.pkg.tar.zst"}, false)
+			},
+			want: []string{"sudo pacman -U --needed --noconfirm a-1-1-x86_64.pkg.tar.zst"},
+		},
+		{
+			name: "remove",
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.remove([]string{"vim", "emacs"})
+			},
+			want: []string{"sudo pacman -Rsc vim emacs"},
+		},
+		{
+			name: "upgrade",
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.upgrade(config, nil)
+			},
+			want: []string{"sudo pacman -Syu --config /etc/nompac/pacman.conf"},
+		},
+		{
+			name: "upgrade and install",
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.upgrade(config, []string{"vim", "git"})
+			},
+			want: []string{"sudo pacman -Syu --config /etc/nompac/pacman.conf vim git"},
+		},
+		{
+			name: "init local repository",
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.init_local_repo(config)
+			},
+			want: []string{"repo-add " + config.Local_repo_path},
+		},
+		{
+			name:   "add to signed local repository",
+			config: Config{Sign_key: "ABCDEF"},
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.add_to_local_repo(config, []string{"/var/tmp/nompac/pkgdest/a/a-1-1-x86_64.pkg.tar.zst"})
+			},
+			want: []string{
+				"# copy /var/tmp/nompac/pkgdest/a/a-1-1-x86_64.pkg.tar.zst to " + repo_dir,
+				"repo-add --sign --key ABCDEF --verify " + config.Local_repo_path + " " + filepath.Join(repo_dir, "a-1-1-x86_64.pkg.tar.zst"),
+			},
+		},
+		{
+			name: "remove from local repository",
+			action: func(manager *pacman_manager, config Config) error {
+				return manager.remove_from_local_repo(config, []string{"a", "b"})
+			},
+			want: []string{"repo-remove " + config.Local_repo_path + " a b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test_config := config
+			test_config.Sign_key = test.config.Sign_key
+			runner := &recording_runner{}
+			if err := test.action(&pacman_manager{runner: runner}, test_config); err != nil {
+				t.Fatal(err)
+			}
+			check_commands(t, runner, test.want)
+		})
+	}
+}
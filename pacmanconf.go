@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// options and repositories of pacman.conf that nompac manages
+type PacmanConfSettings struct {
+	// ParallelDownloads, 0 keeps the value of pacman.conf
+	Parallel_downloads int `json:"parallel_downloads"`
+	// IgnorePkg and HoldPkg, missing lists keep the values of pacman.conf, empty lists remove them
+	Ignore_pkg []string `json:"ignore_pkg"`
+	Hold_pkg   []string `json:"hold_pkg"`
+	// repositories in the order they are written, sections of the same name are replaced
+	Repositories []PacmanRepository `json:"repositories"`
+}
+
+// repository section of pacman.conf
+type PacmanRepository struct {
+	Name     string   `json:"name"`
+	Siglevel string   `json:"siglevel"`
+	Server   []string `json:"server"`
+	// file with the servers, default is the configured mirrorlist (of the repository) if no server is given
+	Include string `json:"include"`
+}
+
+// parsed pacman.conf that keeps comments and unknown lines
+type PacmanConf struct {
+	Sections []PacmanSection
+}
+
+// lines before the first header belong to a section without name
+type PacmanSection struct {
+	Name  string
+	Lines []PacmanLine
+}
+
+// line of a section, Key is empty for comments and blank lines
+type PacmanLine struct {
+	Key   string
+	Value string
+	Raw   string
+}
+
+// first line of the sections that nompac writes
+const pacman_conf_marker = "# managed by nompac, changes are overwritten"
+
+// mirrorlist of the pacman package
+const default_mirrorlist = "/etc/pacman.d/mirrorlist"
+
+func (settings PacmanConfSettings) declared() bool {
+	return settings.Parallel_downloads > 0 || settings.Ignore_pkg != nil || settings.Hold_pkg != nil || len(settings.Repositories) > 0
+}
+
+func parse_pacman_conf(contents string) PacmanConf {
+	conf := PacmanConf{Sections: []PacmanSection{{}}}
+	for _, raw := range strings.Split(strings.TrimSuffix(contents, "\n"), "\n") {
+		line := strings.TrimSpace(raw)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			conf.Sections = append(conf.Sections, PacmanSection{Name: line[1 : len(line)-1]})
+			continue
+		}
+
+		entry := PacmanLine{Raw: raw}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			key, value, _ := strings.Cut(line, "=")
+			entry.Key = strings.TrimSpace(key)
+			entry.Value = strings.TrimSpace(value)
+		}
+		section := &conf.Sections[len(conf.Sections)-1]
+		section.Lines = append(section.Lines, entry)
+	}
+	return conf
+}
+
+func (conf PacmanConf) String() string {
+	var output strings.Builder
+	for i, section := range conf.Sections {
+		if i > 0 {
+			output.WriteString("[" + section.Name + "]\n")
+		}
+		for _, line := range section.Lines {
+			output.WriteString(line.Raw + "\n")
+		}
+	}
+	return output.String()
+}
+
+// returns the section with the name, nil if it doesn't exist
+func (conf *PacmanConf) section(name string) *PacmanSection {
+	for i := range conf.Sections {
+		if i > 0 && conf.Sections[i].Name == name {
+			return &conf.Sections[i]
+		}
+	}
+	return nil
+}
+
+// replaces the first line with the key and removes the others, the line is added if the key is missing
+func (section *PacmanSection) set(key string, value string) {
+	entry := PacmanLine{Key: key, Value: value, Raw: key + " = " + value}
+	var lines []PacmanLine
+	replaced := false
+	for _, line := range section.Lines {
+		if line.Key != key {
+			lines = append(lines, line)
+		} else if !replaced {
+			lines = append(lines, entry)
+			replaced = true
+		}
+	}
+	if !replaced {
+		// the line is added after the last option, comments at the end belong to the next section
+		last := 0
+		for i, line := range lines {
+			if line.Key != "" {
+				last = i + 1
+			}
+		}
+		lines = append(lines[:last], append([]PacmanLine{entry}, lines[last:]...)...)
+	}
+	section.Lines = lines
+}
+
+func (section *PacmanSection) remove(key string) {
+	var lines []PacmanLine
+	for _, line := range section.Lines {
+		if line.Key != key {
+			lines = append(lines, line)
+		}
+	}
+	section.Lines = lines
+}
+
+// sets a list option, nil keeps the option and an empty list removes it
+func (section *PacmanSection) set_list(key string, values []string) {
+	if values == nil {
+		return
+	}
+	if len(values) == 0 {
+		section.remove(key)
+		return
+	}
+	section.set(key, strings.Join(values, " "))
+}
+
+// returns the section of a repository that nompac writes. trailing are the comments at the end of the
+// replaced section, e.g. commented out testing repositories, they are kept
+func repository_section(repository PacmanRepository, trailing []PacmanLine) PacmanSection {
+	section := PacmanSection{Name: repository.Name}
+	add := func(key string, value string) {
+		section.Lines = append(section.Lines, PacmanLine{Key: key, Value: value, Raw: key + " = " + value})
+	}
+	section.Lines = append(section.Lines, PacmanLine{Raw: pacman_conf_marker})
+	if repository.Siglevel != "" {
+		add("SigLevel", repository.Siglevel)
+	}
+	for _, server := range repository.Server {
+		add("Server", server)
+	}
+	if repository.Include != "" {
+		add("Include", repository.Include)
+	}
+	if trailing == nil {
+		trailing = []PacmanLine{{Raw: ""}}
+	}
+	section.Lines = append(section.Lines, trailing...)
+	return section
+}
+
+// returns the comments and blank lines after the last option of a section
+func (section PacmanSection) trailing_lines() []PacmanLine {
+	for i := len(section.Lines) - 1; i >= 0; i-- {
+		if section.Lines[i].Key != "" {
+			return section.Lines[i+1:]
+		}
+	}
+	return section.Lines
+}
+
+// returns true if nompac wrote the section, which starts with pacman_conf_marker then
+func (section PacmanSection) written_by_nompac() bool {
+	return len(section.Lines) > 0 && strings.TrimSpace(section.Lines[0].Raw) == pacman_conf_marker
+}
+
+// returns the repositories that nompac writes: the local repository followed by the declared ones
+func managed_repositories(config Config) []PacmanRepository {
+	var repositories []PacmanRepository
+	if config.Local_repo != "none" {
+		// packages of the local repository are only trusted if they are signed with the configured key
+		siglevel := "Optional TrustAll"
+		if config.Sign_key != "" {
+			siglevel = "Required"
+		}
+		repositories = append(repositories, PacmanRepository{
+			Name:     local_repo_name(config),
+			Siglevel: siglevel,
+			Server:   []string{"file://" + filepath.Dir(config.Local_repo_path)},
+		})
+	}
+	for _, repository := range config.Pacman_conf.Repositories {
+		if len(repository.Server) == 0 && repository.Include == "" {
+			repository.Include = repo_mirrorlist(config, repository.Name)
+		}
+		repositories = append(repositories, repository)
+	}
+	return repositories
+}
+
+// returns true if the include is the mirrorlist nompac writes for the repository: the configured mirrorlist,
+// the one of the pacman package or the own mirrorlist of the repository. Other mirrorlists like the one
+// of chaotic-aur aren't touched
+func nompac_mirrorlist(config Config, repository string, include string) bool {
+	return include == config.Mirrorlist || include == default_mirrorlist || include == config.Mirrorlist+"-"+repository
+}
+
+// applies the managed options and repositories. The managed repositories are written in their order
+// in front of the repositories that aren't declared, those keep their order and point to the configured mirrorlist
+// or the mirrorlist of the repository if it has its own snapshot
+func manage_pacman_conf(config Config, conf PacmanConf) PacmanConf {
+	options := conf.section("options")
+	if options == nil {
+		// the blank line separates the options from the first repository
+		section := PacmanSection{Name: "options", Lines: []PacmanLine{{Raw: ""}}}
+		conf.Sections = append(conf.Sections[:1], append([]PacmanSection{section}, conf.Sections[1:]...)...)
+		options = conf.section("options")
+	}
+	if config.Pacman_conf.Parallel_downloads > 0 {
+		options.set("ParallelDownloads", fmt.Sprint(config.Pacman_conf.Parallel_downloads))
+	}
+	options.set_list("IgnorePkg", config.Pacman_conf.Ignore_pkg)
+	options.set_list("HoldPkg", config.Pacman_conf.Hold_pkg)
+
+	repositories := managed_repositories(config)
+	managed := map[string]bool{}
+	for _, repository := range repositories {
+		managed[repository.Name] = true
+	}
+
+	// sections that nompac wrote for repositories that are no longer managed are removed, e.g. a removed
+	// repository or a renamed local repository. Comments after their options stay with the previous section
+	var kept []PacmanSection
+	for i, section := range conf.Sections {
+		if i == 0 || managed[section.Name] || !section.written_by_nompac() {
+			kept = append(kept, section)
+			continue
+		}
+		var comments []PacmanLine
+		for _, line := range section.trailing_lines() {
+			text := strings.TrimSpace(line.Raw)
+			if text != pacman_conf_marker && (text != "" || len(comments) > 0) {
+				comments = append(comments, line)
+			}
+		}
+		previous := &kept[len(kept)-1]
+		previous.Lines = append(previous.Lines, comments...)
+	}
+
+	var sections, unmanaged []PacmanSection
+	trailing := map[string][]PacmanLine{}
+	for i, section := range kept {
+		switch {
+		case i == 0 || section.Name == "options":
+			sections = append(sections, section)
+		case managed[section.Name]:
+			trailing[section.Name] = section.trailing_lines()
+		default:
+			mirrorlist := repo_mirrorlist(config, section.Name)
+			for j, line := range section.Lines {
+				if line.Key == "Include" && nompac_mirrorlist(config, section.Name, line.Value) {
+					section.Lines[j] = PacmanLine{Key: "Include", Value: mirrorlist, Raw: "Include = " + mirrorlist}
+				}
+			}
+			unmanaged = append(unmanaged, section)
+		}
+	}
+	for _, repository := range repositories {
+		sections = append(sections, repository_section(repository, trailing[repository.Name]))
+	}
+	conf.Sections = append(sections, unmanaged...)
+	return conf
+}
+
+// returns true if pacconfig is written in every run: if options, repositories or snapshots per repository
+// are declared or if pacconfig still includes the mirrorlist of a repository whose snapshot was removed
+// or sections that nompac wrote, which are removed once their repository is no longer managed
+func pacman_conf_managed(config Config) bool {
+	if config.Pacman_conf.declared() || len(config.Repo_snapshots) > 0 {
+		return true
+	}
+	contents, _ := os.ReadFile(config.Pacconfig)
+	return strings.Contains(string(contents), config.Mirrorlist+"-") || strings.Contains(string(contents), pacman_conf_marker)
+}
+
+// returns the repositories of pacconfig whose servers come from the mirrorlist nompac writes
+// and are affected by the snapshot
+func snapshot_repositories(config Config) []string {
+	contents, err := os.ReadFile(config.Pacconfig)
+	if err != nil {
+		return nil
+	}
+	var repositories []string
+	for _, section := range parse_pacman_conf(string(contents)).Sections[1:] {
+		for _, line := range section.Lines {
+			if line.Key == "Include" && nompac_mirrorlist(config, section.Name, line.Value) {
+				repositories = append(repositories, section.Name)
+				break
+			}
+		}
+	}
+	return repositories
+}
+
+// writes the managed options and repositories to pacconfig, the file is only written if it changes.
+// The mirrorlists of repositories with their own snapshot are written first so that pacconfig never
+// includes a missing file
+func write_pacman_conf(config Config) error {
+	if err := write_repo_mirrorlists(config); err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(config.Pacconfig)
+	if err != nil {
+		return fmt.Errorf("couldn't read pacconfig %s: %w", config.Pacconfig, err)
+	}
+	managed := manage_pacman_conf(config, parse_pacman_conf(string(contents))).String()
+	if managed == string(contents) {
+		return nil
+	}
+
+	return config.Runner.modify("write the managed options and repositories to "+config.Pacconfig, func() error {
+		temp_file := config.Pacconfig + ".tmp"
+		if err := os.WriteFile(temp_file, []byte(managed), 0644); err != nil {
+			return fmt.Errorf("couldn't write pacconfig %s: %w", config.Pacconfig, err)
+		}
+		return os.Rename(temp_file, config.Pacconfig)
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParsePacmanConf(t *testing.T) {
+	example, err := os.ReadFile("configs/pacman.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"example config", string(example)},
+		{"preamble", "# pacman.conf\n\n[options]\nArchitecture = auto\n"},
+		{"indented and flag options", "[options]\n  HoldPkg   = pacman glibc\nCheckSpace\n\n"},
+		{"blank lines at the end", "[core]\nInclude = /etc/pacman.d/mirrorlist\n\n\n"},
+		{"commented out repositories", "[core]\nInclude = /etc/pacman.d/mirrorlist\n\n#[core-testing]\n#Include = /etc/pacman.d/mirrorlist\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if output := parse_pacman_conf(test.contents).String(); output != test.contents {
+				t.Errorf("String() changed the unmodified config:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestManagePacmanConf(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		contents string
+		want     string
+	}{
+		{
+			name:     "missing options section",
+			config:   Config{Local_repo: "none", Mirrorlist: "/etc/pacman.d/mirrorlist", Pacman_conf: PacmanConfSettings{Parallel_downloads: 5}},
+			contents: "# pacman.conf\n[core]\nInclude = /etc/pacman.d/mirrorlist\n",
+			want:     "# pacman.conf\n[options]\nParallelDownloads = 5\n\n[core]\nInclude = /etc/pacman.d/mirrorlist\n",
+		},
+		{
+			name: "trailing comments of replaced sections",
+			config: Config{
+				Local_repo: "none",
+				Mirrorlist: "/etc/pacman.d/mirrorlist",
+				Pacman_conf: PacmanConfSettings{
+					Ignore_pkg:   []string{"linux"},
+					Hold_pkg:     []string{},
+					Repositories: []PacmanRepository{{Name: "core", Siglevel: "PackageRequired"}},
+				},
+			},
+			contents: `[options]
+HoldPkg = pacman glibc
+Architecture = auto
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+
+#[core-testing]
+#Include = /etc/pacman.d/mirrorlist
+
+[extra]
+Include = /etc/pacman.d/mirrorlist
+`,
+			want: `[options]
+Architecture = auto
+IgnorePkg = linux
+
+[core]
+# managed by nompac, changes are overwritten
+SigLevel = PackageRequired
+Include = /etc/pacman.d/mirrorlist
+
+#[core-testing]
+#Include = /etc/pacman.d/mirrorlist
+
+[extra]
+Include = /etc/pacman.d/mirrorlist
+`,
+		},
+		{
+			name: "local repository and own snapshot",
+			config: Config{
+				Local_repo:      "nomispaz",
+				Local_repo_path: "/home/user/repo/nomispaz.db.tar.zst",
+				Mirrorlist:      "/home/user/nompac/mirrorlist",
+				Repo_snapshots:  map[string]string{"multilib": "2024_11_20"},
+			},
+			contents: `[options]
+Architecture = auto
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+
+[multilib]
+Include = /home/user/nompac/mirrorlist
+
+[chaotic-aur]
+Include = /etc/pacman.d/chaotic-mirrorlist
+`,
+			want: `[options]
+Architecture = auto
+
+[nomispaz]
+# managed by nompac, changes are overwritten
+SigLevel = Optional TrustAll
+Server = file:///home/user/repo
+
+[core]
+Include = /home/user/nompac/mirrorlist
+
+[multilib]
+Include = /home/user/nompac/mirrorlist-multilib
+
+[chaotic-aur]
+Include = /etc/pacman.d/chaotic-mirrorlist
+`,
+		},
+		{
+			name:   "removed own snapshot",
+			config: Config{Local_repo: "none", Mirrorlist: "/home/user/nompac/mirrorlist"},
+			contents: `[options]
+Architecture = auto
+
+[multilib]
+Include = /home/user/nompac/mirrorlist-multilib
+`,
+			want: `[options]
+Architecture = auto
+
+[multilib]
+Include = /home/user/nompac/mirrorlist
+`,
+		},
+		{
+			name:   "removed repository and local repository",
+			config: Config{Local_repo: "none", Mirrorlist: "/etc/pacman.d/mirrorlist"},
+			contents: `[options]
+Architecture = auto
+
+[nomispaz]
+# managed by nompac, changes are overwritten
+SigLevel = Optional TrustAll
+Server = file:///home/user/repo
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+
+[custom]
+# managed by nompac, changes are overwritten
+Server = https://example.org/$arch
+
+#[core-testing]
+#Include = /etc/pacman.d/mirrorlist
+
+[extra]
+Include = /etc/pacman.d/mirrorlist
+`,
+			want: `[options]
+Architecture = auto
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+
+#[core-testing]
+#Include = /etc/pacman.d/mirrorlist
+
+[extra]
+Include = /etc/pacman.d/mirrorlist
+`,
+		},
+		{
+			name: "renamed local repository",
+			config: Config{
+				Local_repo:      "custom",
+				Local_repo_path: "/home/user/repo/custom.db.tar.zst",
+				Mirrorlist:      "/etc/pacman.d/mirrorlist",
+			},
+			contents: `[options]
+Architecture = auto
+
+[nomispaz]
+# managed by nompac, changes are overwritten
+SigLevel = Optional TrustAll
+Server = file:///home/user/repo
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+`,
+			want: `[options]
+Architecture = auto
+
+[custom]
+# managed by nompac, changes are overwritten
+SigLevel = Optional TrustAll
+Server = file:///home/user/repo
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			once := manage_pacman_conf(test.config, parse_pacman_conf(test.contents)).String()
+			if once != test.want {
+				t.Errorf("manage_pacman_conf() =\n%s\nwant\n%s", once, test.want)
+			}
+			// applying the settings to the written config doesn't change it again
+			if twice := manage_pacman_conf(test.config, parse_pacman_conf(once)).String(); twice != once {
+				t.Errorf("second manage_pacman_conf() changed the config:\n%s", twice)
+			}
+		})
+	}
+}
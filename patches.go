@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// patch of a package from the official repositories.
+// In the config a patch is either only the file name or an object with these fields
+type PatchSpec struct {
+	File string `json:"file"`
+	// strip level, the number of leading path components removed from the file names in the patch
+	Strip int `json:"strip"`
+	// subdirectory of the source directory the patch is applied in
+	Dir string `json:"dir"`
+	// patches are applied in ascending order, patches with the same order keep the order of the config
+	Order int `json:"order"`
+	// "patch" (default) or "git" for git apply
+	Mode string `json:"mode"`
+	// upstream versions the patch applies to, e.g. ">=0.17 <0.18" or "0.17.*"
+	Versions string `json:"versions"`
+	// fail instead of skipping the patch if the upstream version doesn't match
+	Required bool `json:"required"`
+}
+
+// reads a patch from the config as file name or object
+func (patch *PatchSpec) UnmarshalJSON(data []byte) error {
+	var file string
+	if err := json.Unmarshal(data, &file); err == nil {
+		*patch = PatchSpec{File: file, Strip: 1}
+		return nil
+	}
+
+	// the alias type prevents a recursive call of UnmarshalJSON
+	type patch_object PatchSpec
+	object := patch_object{Strip: 1}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	if object.File == "" {
+		return fmt.Errorf("patch without file: %s", string(data))
+	}
+	if object.Mode != "" && object.Mode != "patch" && object.Mode != "git" {
+		return fmt.Errorf("unknown mode %s of patch %s, use patch or git", object.Mode, object.File)
+	}
+	*patch = PatchSpec(object)
+	return nil
+}
+
+// returns the shell command that applies the patch file
+func (patch PatchSpec) command(patch_file string) string {
+	if patch.Mode == "git" {
+		return fmt.Sprintf("git apply -p%d \"%s\"", patch.Strip, patch_file)
+	}
+	return fmt.Sprintf("patch -Np%d -i \"%s\"", patch.Strip, patch_file)
+}
+
+// returns the patches that apply to the upstream version sorted by their order.
+// returns an error if a required patch doesn't support the version
+func select_patches(packagename string, version string, patches []PatchSpec) ([]PatchSpec, error) {
+	var selected []PatchSpec
+	for _, patch := range patches {
+		if version_in_range(version, patch.Versions) {
+			selected = append(selected, patch)
+			continue
+		}
+		if patch.Required {
+			return nil, fmt.Errorf("Patch %s of %s requires upstream version %s, but the upstream version is %s.", patch.File, packagename, patch.Versions, version)
+		}
+		fmt.Printf(Yellow+"Skipping patch %s of %s: upstream version %s doesn't match %s\n"+Reset, patch.File, packagename, version, patch.Versions)
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Order < selected[j].Order
+	})
+	return selected, nil
+}
+
+// checks if the version matches all space separated constraints like ">=0.17", "<0.18", "=0.17.4" or "0.17.*".
+// an empty range matches every version
+func version_in_range(version string, version_range string) bool {
+	_, pkgver, _ := parse_evr(version)
+
+	for _, constraint := range strings.Fields(version_range) {
+		operator := constraint[:len(constraint)-len(strings.TrimLeft(constraint, "<>=!"))]
+		bound := strings.TrimPrefix(constraint, operator)
+
+		if strings.HasSuffix(bound, "*") {
+			prefix := strings.TrimSuffix(bound, "*")
+			if strings.HasPrefix(pkgver, prefix) != (operator != "!=") {
+				return false
+			}
+			continue
+		}
+
+		result := vercmp(version, bound)
+		var matches bool
+		switch operator {
+		case ">=":
+			matches = result >= 0
+		case "<=":
+			matches = result <= 0
+		case ">":
+			matches = result > 0
+		case "<":
+			matches = result < 0
+		case "!=":
+			matches = result != 0
+		default:
+			matches = result == 0
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
+
+// result of applying a patch in dry-run mode
+type PatchResult struct {
+	Patch  string
+	Ok     bool
+	Fuzzy  []string
+	Failed []FailedHunk
+	Output string
+}
+
+// hunk of a patch that couldn't be applied
+type FailedHunk struct {
+	File string
+	// number of the hunk in the file (patch) or the line of the hunk in the original file (git apply)
+	Hunk int
+	Line int
+}
+
+var hunk_header_regex = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+var git_apply_failed_regex = regexp.MustCompile(`^error: patch failed: (.+):(\d+)$`)
+
+var hunk_result_regex = regexp.MustCompile(`^Hunk #(\d+) (succeeded|FAILED) at (\d+)(.*)\.$`)
+
+// handles "nompac patch <subcommand>"
+func patch_command(config Config, command []string) {
+	if len(command) == 0 || command[0] != "check" {
+		fmt.Println(Red + "Missing or unknown patch command. Available: check [pkg]" + Reset)
+		os.Exit(2)
+	}
+
+	patched := patched_packages(config)
+	lock := read_lockfile(config)
+	packages := command[1:]
+	if len(packages) == 0 {
+		for pkg := range patched {
+			packages = append(packages, pkg)
+		}
+	}
+
+	all_ok := true
+	for _, pkg := range packages {
+		patches, ok := patched[pkg]
+		if !ok {
+			fmt.Println(Red + "No patches configured for " + pkg + Reset)
+			all_ok = false
+			continue
+		}
+
+		fmt.Println(Blue + "\nChecking patches of " + pkg + Reset)
+		package_version_repo := get_current_version_from_repo(pkg)
+
+		patches, err := select_patches(pkg, package_version_repo, patches)
+		if err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			all_ok = false
+			continue
+		}
+
+		pkg_build_dir, err := prepare_upstream_work_dir(config, &lock, pkg, package_version_repo)
+		if err != nil {
+			fmt.Println(Red + err.Error() + Reset)
+			all_ok = false
+			continue
+		}
+		if !check_patches(config, pkg, pkg_build_dir, patches) {
+			all_ok = false
+		}
+		os.RemoveAll(pkg_build_dir)
+	}
+
+	if !all_ok {
+		os.Exit(1)
+	}
+}
+
+// fetches and extracts the sources of the package in pkg_build_dir and applies the patches in dry-run mode.
+// every patch that applies is applied to the extracted tree so that the following patches are checked
+// against the same tree they will see during the build. makepkg -C removes the tree again before building.
+// returns false if a patch doesn't apply
+func check_patches(config Config, packagename string, pkg_build_dir string, patches []PatchSpec) bool {
+	if len(patches) == 0 {
+		return true
+	}
+
+	fmt.Println("Fetching sources of " + packagename)
+	if err := import_pgp_keys(config, packagename, pkg_build_dir); err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return false
+	}
+	srcdest := prepare_srcdest(config, packagename)
+	err := execCmd("cd " + pkg_build_dir + " && SRCDEST=" + srcdest + " makepkg --nobuild --noprepare --nodeps" + makepkg_pgp_flags(config, packagename))
+	store_sources(config, srcdest)
+	if err != nil {
+		fmt.Printf(Red+"Couldn't fetch the sources of %s: %s\n"+Reset, packagename, err)
+		return false
+	}
+
+	source_dir := find_source_dir(pkg_build_dir, packagename)
+
+	all_ok := true
+	for _, patch := range patches {
+		patch_file := filepath.Join(config.Patch_dir, packagename, patch.File)
+		patch_dir := filepath.Join(source_dir, patch.Dir)
+		result := dry_run_patch(patch_dir, patch_file, patch)
+		result.Patch = patch.File
+		print_patch_result(result, patch_file)
+
+		if !result.Ok {
+			all_ok = false
+			continue
+		}
+		cmd := exec.Command("bash", "-c", patch.command(patch_file))
+		cmd.Dir = patch_dir
+		if err := cmd.Run(); err != nil {
+			fmt.Printf(Red+"Couldn't apply %s to the checked tree: %s\n"+Reset, patch.File, err)
+			all_ok = false
+		}
+	}
+	return all_ok
+}
+
+// returns the directory inside src/ in which the patches are applied.
+// if the sources extract to exactly one directory that is used, otherwise <pkgname>-<pkgver>
+func find_source_dir(pkg_build_dir string, packagename string) string {
+	src_dir := filepath.Join(pkg_build_dir, "src")
+
+	var directories []string
+	entries, _ := os.ReadDir(src_dir)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			directories = append(directories, entry.Name())
+		}
+	}
+	if len(directories) == 1 {
+		return filepath.Join(src_dir, directories[0])
+	}
+
+	contents, _ := os.ReadFile(filepath.Join(pkg_build_dir, "PKGBUILD"))
+	pkgver := strings.Split(get_version_from_pkgbuild(string(contents)), "-")[0]
+	return filepath.Join(src_dir, packagename+"-"+pkgver)
+}
+
+// runs patch or git apply in dry-run mode in source_dir and collects the result of every hunk
+func dry_run_patch(source_dir string, patch_file string, patch PatchSpec) PatchResult {
+	var cmd *exec.Cmd
+	if patch.Mode == "git" {
+		cmd = exec.Command("git", "apply", "--check", "-v", fmt.Sprintf("-p%d", patch.Strip), patch_file)
+	} else {
+		cmd = exec.Command("patch", fmt.Sprintf("-Np%d", patch.Strip), "--dry-run", "-i", patch_file)
+	}
+	cmd.Dir = source_dir
+	output, err := cmd.CombinedOutput()
+
+	result := PatchResult{Ok: err == nil, Output: string(output)}
+
+	current_file := ""
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "checking file ") {
+			current_file = strings.TrimPrefix(line, "checking file ")
+			continue
+		}
+		if match := git_apply_failed_regex.FindStringSubmatch(line); match != nil {
+			line_number, _ := strconv.Atoi(match[2])
+			result.Failed = append(result.Failed, FailedHunk{File: match[1], Line: line_number})
+			continue
+		}
+		match := hunk_result_regex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		hunk, _ := strconv.Atoi(match[1])
+		if match[2] == "FAILED" {
+			result.Failed = append(result.Failed, FailedHunk{File: current_file, Hunk: hunk})
+		} else if strings.Contains(match[4], "fuzz") {
+			result.Fuzzy = append(result.Fuzzy, fmt.Sprintf("%s: hunk #%d at line %s%s", current_file, hunk, match[3], match[4]))
+		}
+	}
+	return result
+}
+
+// prints the result of a dry-run together with the hunks that couldn't be applied
+func print_patch_result(result PatchResult, patch_file string) {
+	switch {
+	case result.Ok && len(result.Fuzzy) == 0:
+		fmt.Println(Green + "  " + result.Patch + ": applies cleanly" + Reset)
+	case result.Ok:
+		fmt.Println(Yellow + "  " + result.Patch + ": applies with fuzz" + Reset)
+		for _, fuzzy := range result.Fuzzy {
+			fmt.Println("    " + fuzzy)
+		}
+	default:
+		fmt.Println(Red + "  " + result.Patch + ": doesn't apply" + Reset)
+		if len(result.Failed) == 0 {
+			fmt.Println(result.Output)
+			return
+		}
+		hunks := read_patch_hunks(patch_file)
+		for _, failed := range result.Failed {
+			file_hunks := find_file_hunks(hunks, failed.File)
+			if failed.Hunk == 0 {
+				// git apply reports the line of the hunk in the original file
+				fmt.Printf(Red+"    %s: hunk at line %d FAILED\n"+Reset, failed.File, failed.Line)
+				for _, hunk := range file_hunks {
+					if match := hunk_header_regex.FindStringSubmatch(hunk); match != nil && match[1] == strconv.Itoa(failed.Line) {
+						fmt.Println(hunk)
+					}
+				}
+				continue
+			}
+			fmt.Printf(Red+"    %s: hunk #%d FAILED\n"+Reset, failed.File, failed.Hunk)
+			if failed.Hunk <= len(file_hunks) {
+				fmt.Println(file_hunks[failed.Hunk-1])
+			}
+		}
+	}
+}
+
+// reads a unified diff and returns the hunks of every patched file
+func read_patch_hunks(patch_file string) map[string][]string {
+	hunks := map[string][]string{}
+
+	file, err := os.Open(patch_file)
+	if err != nil {
+		return hunks
+	}
+	defer file.Close()
+
+	current_file := ""
+	// lines of the current hunk that haven't been read yet for the old and the new file
+	old_lines, new_lines := 0, 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if old_lines > 0 || new_lines > 0 {
+			file_hunks := hunks[current_file]
+			file_hunks[len(file_hunks)-1] += "\n" + line
+			switch {
+			case strings.HasPrefix(line, "-"):
+				old_lines--
+			case strings.HasPrefix(line, "+"):
+				new_lines--
+			case strings.HasPrefix(line, "\\"):
+			default:
+				old_lines--
+				new_lines--
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "+++ ") {
+			current_file = strings.Fields(strings.TrimPrefix(line, "+++ "))[0]
+			continue
+		}
+		if match := hunk_header_regex.FindStringSubmatch(line); match != nil && current_file != "" {
+			old_lines, new_lines = 1, 1
+			if match[2] != "" {
+				old_lines, _ = strconv.Atoi(match[2])
+			}
+			if match[4] != "" {
+				new_lines, _ = strconv.Atoi(match[4])
+			}
+			hunks[current_file] = append(hunks[current_file], line)
+		}
+	}
+	return hunks
+}
+
+// returns the hunks of the file that patch reported, the paths in the patch still contain the prefix
+func find_file_hunks(hunks map[string][]string, file string) []string {
+	for path, file_hunks := range hunks {
+		if path == file || strings.HasSuffix(path, "/"+file) {
+			return file_hunks
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestVersionInRange(t *testing.T) {
+	tests := []struct {
+		version       string
+		version_range string
+		want          bool
+	}{
+		{"0.17.4-2", "", true},
+		{"0.17.4-2", "0.17.*", true},
+		{"0.17-1", "0.17.*", false},
+		{"0.170-1", "0.17.*", false},
+		{"0.18.0-1", "0.17.*", false},
+		{"1:0.17.4-1", "0.17.*", true},
+		{"0.17.4-2", "!=0.17.*", false},
+		{"0.16.1-1", "!=0.17.*", true},
+		{"0.17.4-2", ">=0.17 <0.18", true},
+		{"0.17-1", ">=0.17 <0.18", true},
+		{"0.18.0-1", ">=0.17 <0.18", false},
+		{"0.18rc1-1", ">=0.17 <0.18", true},
+		{"0.16.9-1", ">=0.17 <0.18", false},
+		{"0.17.4-2", "=0.17.4", true},
+		{"0.17.4-2", "0.17.4", true},
+		{"0.17.4-2", "=0.17.4-1", false},
+		{"0.17.4-2", "!=0.17.4", false},
+		{"0.17.4-2", ">0.17.4-1", true},
+		{"0.17.4-2", ">0.17.4", false},
+		{"0.17.4-1", "<=0.17.4", true},
+		{"1:0.1-1", ">0.17", true},
+	}
+
+	for _, test := range tests {
+		if result := version_in_range(test.version, test.version_range); result != test.want {
+			t.Errorf("version_in_range(%s, %q) = %t, want %t", test.version, test.version_range, result, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// returns the flag that disables the PGP verification of the sources for packages listed in skip_pgp_check
+func makepkg_pgp_flags(config Config, packagename string) string {
+	if contains(config.Skip_pgp_check, packagename) {
+		return " --skippgpcheck"
+	}
+	return ""
+}
+
+// imports the keys listed in validpgpkeys of the PKGBUILD in pkg_build_dir into the gpg keyring of the user,
+// so that makepkg can verify the signatures of the sources. Keys are read from <fingerprint>.asc in
+// pgp_keyring, in keys/pgp of the packaging files or in keys/pgp of the overlay
+func import_pgp_keys(config Config, packagename string, pkg_build_dir string) error {
+	if contains(config.Skip_pgp_check, packagename) {
+		fmt.Println(Yellow + "PGP verification of the sources of " + packagename + " is disabled in the config." + Reset)
+		return nil
+	}
+
+	pkgbuild, err := read_pkgbuild(filepath.Join(pkg_build_dir, "PKGBUILD"))
+	if err != nil {
+		return fmt.Errorf("couldn't read PKGBUILD of %s: %w", packagename, err)
+	}
+
+	key_dirs := []string{
+		filepath.Join(pkg_build_dir, "keys", "pgp"),
+		filepath.Join(config.Overlay_dir, packagename, "keys", "pgp"),
+	}
+	if config.Pgp_keyring != "" {
+		key_dirs = append([]string{config.Pgp_keyring}, key_dirs...)
+	}
+
+	var missing []string
+	for _, fingerprint := range pkgbuild.array("validpgpkeys") {
+		fingerprint = strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+		if has_pgp_key(fingerprint) {
+			continue
+		}
+
+		imported := false
+		for _, dir := range key_dirs {
+			key_file := filepath.Join(dir, fingerprint+".asc")
+			if _, err := os.Stat(key_file); err != nil {
+				continue
+			}
+			fmt.Println("Importing PGP key " + fingerprint + " from " + key_file)
+			if output, err := exec.Command("gpg", "--batch", "--import", key_file).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to import %s: %s", key_file, strings.TrimSpace(string(output)))
+			}
+			imported = has_pgp_key(fingerprint)
+			break
+		}
+		if !imported {
+			missing = append(missing, fingerprint)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("PGP keys of %s not found: %s. Add <fingerprint>.asc to pgp_keyring or disable the check with skip_pgp_check",
+			packagename, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checks whether the public key with the fingerprint is in the gpg keyring of the user
+func has_pgp_key(fingerprint string) bool {
+	return exec.Command("gpg", "--batch", "--list-keys", fingerprint).Run() == nil
+}
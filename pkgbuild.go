@@ -0,0 +1,545 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// kinds of nodes of a parsed PKGBUILD
+const (
+	pkgbuild_text = iota
+	pkgbuild_variable
+	pkgbuild_function
+)
+
+// checksum arrays that have one entry per entry of the source array
+var checksum_arrays = []string{"cksums", "md5sums", "sha1sums", "sha224sums", "sha256sums", "sha384sums", "sha512sums", "b2sums"}
+
+var variable_regex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(\+?=)`)
+var command_separator_regex = regexp.MustCompile(`;|&&|\|\|`)
+var plain_word_regex = regexp.MustCompile(`^[A-Za-z0-9._+:/@%=,-]+$`)
+var function_header_regex = regexp.MustCompile(`^\s*(?:function\s+)?([A-Za-z_][A-Za-z0-9_-]*)\s*\(\s*\)\s*(\{.*)?$`)
+
+// node of a parsed PKGBUILD: a top level variable assignment, a function or any other text.
+// the original lines are kept so that unmodified parts are written back unchanged
+type PkgbuildNode struct {
+	Kind  int
+	Name  string
+	Lines []string
+}
+
+// structured model of a PKGBUILD
+type Pkgbuild struct {
+	Nodes []*PkgbuildNode
+}
+
+// keeps track of quotes and the nesting depth while reading shell code line by line
+type shell_scanner struct {
+	single  bool
+	double  bool
+	escaped bool
+	depth   int
+	opened  bool
+}
+
+// reads a line of shell code and counts the open and close characters outside of quotes and comments
+func (scanner *shell_scanner) feed(line string, open byte, close byte) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if scanner.escaped {
+			scanner.escaped = false
+			continue
+		}
+		switch {
+		case scanner.single:
+			if c == '\'' {
+				scanner.single = false
+			}
+		case c == '\\':
+			scanner.escaped = true
+		case scanner.double:
+			if c == '"' {
+				scanner.double = false
+			}
+		case c == '\'':
+			scanner.single = true
+		case c == '"':
+			scanner.double = true
+		case c == '#' && (i == 0 || strings.ContainsRune(" \t(;", rune(line[i-1]))):
+			// the rest of the line is a comment
+			return
+		case c == open:
+			scanner.depth++
+			scanner.opened = true
+		case c == close:
+			scanner.depth--
+		}
+	}
+	scanner.escaped = false
+}
+
+// returns true if the scanner is outside of quotes and all opened characters were closed
+func (scanner *shell_scanner) balanced() bool {
+	return scanner.depth <= 0 && !scanner.single && !scanner.double
+}
+
+// parses the contents of a PKGBUILD into variables, functions and other text
+func parse_pkgbuild(contents string) *Pkgbuild {
+	pkgbuild := &Pkgbuild{}
+	lines := strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if match := function_header_regex.FindStringSubmatch(line); match != nil {
+			node := &PkgbuildNode{Kind: pkgbuild_function, Name: match[1]}
+			scanner := shell_scanner{}
+			for ; i < len(lines); i++ {
+				node.Lines = append(node.Lines, lines[i])
+				scanner.feed(lines[i], '{', '}')
+				if scanner.opened && scanner.balanced() {
+					break
+				}
+			}
+			pkgbuild.Nodes = append(pkgbuild.Nodes, node)
+			continue
+		}
+
+		if match := variable_regex.FindStringSubmatch(line); match != nil {
+			node := &PkgbuildNode{Kind: pkgbuild_variable, Name: match[1]}
+			scanner := shell_scanner{}
+			for ; i < len(lines); i++ {
+				node.Lines = append(node.Lines, lines[i])
+				scanner.feed(lines[i], '(', ')')
+				if scanner.balanced() {
+					break
+				}
+			}
+			pkgbuild.Nodes = append(pkgbuild.Nodes, node)
+			continue
+		}
+
+		pkgbuild.Nodes = append(pkgbuild.Nodes, &PkgbuildNode{Kind: pkgbuild_text, Lines: []string{line}})
+	}
+	return pkgbuild
+}
+
+// reads and parses a PKGBUILD file
+func read_pkgbuild(file string) (*Pkgbuild, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parse_pkgbuild(string(contents)), nil
+}
+
+// writes the PKGBUILD to file
+func (pkgbuild *Pkgbuild) write(file string) error {
+	return os.WriteFile(file, []byte(pkgbuild.String()), 0644)
+}
+
+func (pkgbuild *Pkgbuild) String() string {
+	var lines []string
+	for _, node := range pkgbuild.Nodes {
+		lines = append(lines, node.Lines...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// returns the last top level assignment of the variable or nil
+func (pkgbuild *Pkgbuild) variable(name string) *PkgbuildNode {
+	var found *PkgbuildNode
+	for _, node := range pkgbuild.Nodes {
+		if node.Kind == pkgbuild_variable && node.Name == name {
+			found = node
+		}
+	}
+	return found
+}
+
+// returns the function or nil
+func (pkgbuild *Pkgbuild) function(name string) *PkgbuildNode {
+	for _, node := range pkgbuild.Nodes {
+		if node.Kind == pkgbuild_function && node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// returns the unquoted value of a scalar variable
+func (pkgbuild *Pkgbuild) value(name string) string {
+	node := pkgbuild.variable(name)
+	if node == nil {
+		return ""
+	}
+	words := split_shell_words(node.value_text())
+	if len(words) == 0 {
+		return ""
+	}
+	return unquote_shell_word(words[0])
+}
+
+// returns the unquoted entries of an array including entries added with +=
+func (pkgbuild *Pkgbuild) array(name string) []string {
+	var values []string
+	for _, node := range pkgbuild.Nodes {
+		if node.Kind != pkgbuild_variable || node.Name != name {
+			continue
+		}
+		if !node.is_append() {
+			values = nil
+		}
+		for _, word := range split_shell_words(node.array_text()) {
+			values = append(values, unquote_shell_word(word))
+		}
+	}
+	return values
+}
+
+// sets a scalar variable to the given shell code, e.g. pkgrel=2
+func (pkgbuild *Pkgbuild) set_variable(name string, value string) {
+	line := name + "=" + value
+	if node := pkgbuild.variable(name); node != nil && !node.is_append() {
+		node.Lines = []string{line}
+		return
+	}
+	pkgbuild.insert_variable(&PkgbuildNode{Kind: pkgbuild_variable, Name: name, Lines: []string{line}})
+}
+
+// replaces an array with the given values
+func (pkgbuild *Pkgbuild) set_array(name string, values []string) {
+	var quoted []string
+	for _, value := range values {
+		quoted = append(quoted, quote_shell_word(value))
+	}
+	line := name + "=(" + strings.Join(quoted, " ") + ")"
+
+	// later += assignments would add to the replaced values
+	var nodes []*PkgbuildNode
+	for _, node := range pkgbuild.Nodes {
+		if !(node.Kind == pkgbuild_variable && node.Name == name && node.is_append()) {
+			nodes = append(nodes, node)
+		}
+	}
+	pkgbuild.Nodes = nodes
+
+	if node := pkgbuild.variable(name); node != nil {
+		node.Lines = []string{line}
+		return
+	}
+	pkgbuild.insert_variable(&PkgbuildNode{Kind: pkgbuild_variable, Name: name, Lines: []string{line}})
+}
+
+// appends values to an array in the style of the existing assignment
+func (pkgbuild *Pkgbuild) append_array(name string, values ...string) {
+	node := pkgbuild.variable(name)
+	if node == nil {
+		pkgbuild.set_array(name, values)
+		return
+	}
+	if !node.is_array() {
+		pkgbuild.set_array(name, append([]string{pkgbuild.value(name)}, values...))
+		return
+	}
+
+	style := ""
+	if words := split_shell_words(node.array_text()); len(words) > 0 {
+		style = words[0]
+	}
+
+	for _, value := range values {
+		quoted := quote_shell_word_like(style, value)
+		last := node.Lines[len(node.Lines)-1]
+		index := strings.LastIndex(last, ")")
+
+		switch {
+		case len(node.Lines) == 1:
+			// name=(a b)
+			separator := " "
+			if strings.HasSuffix(last[:index], "(") {
+				separator = ""
+			}
+			node.Lines[0] = last[:index] + separator + quoted + last[index:]
+		case strings.TrimSpace(last[:index]) == "":
+			// the closing parenthesis is on its own line
+			node.Lines = append(node.Lines[:len(node.Lines)-1], node.array_indent()+quoted, last)
+		default:
+			// the closing parenthesis follows the last value
+			node.Lines = append(node.Lines[:len(node.Lines)-1], last[:index], node.array_indent()+quoted+last[index:])
+		}
+	}
+}
+
+// inserts a new variable after the last variable with the same prefix (e.g. source_x86_64 for source)
+// or after the last variable in front of the first function
+func (pkgbuild *Pkgbuild) insert_variable(new_node *PkgbuildNode) {
+	last_variable, last_related := -1, -1
+	for index, node := range pkgbuild.Nodes {
+		if node.Kind == pkgbuild_function {
+			break
+		}
+		if node.Kind == pkgbuild_variable {
+			last_variable = index
+			if strings.HasPrefix(node.Name, new_node.Name) {
+				last_related = index
+			}
+		}
+	}
+
+	position := last_variable
+	if last_related >= 0 {
+		position = last_related
+	}
+	pkgbuild.insert_node(position+1, new_node)
+}
+
+// inserts a node at position
+func (pkgbuild *Pkgbuild) insert_node(position int, node *PkgbuildNode) {
+	pkgbuild.Nodes = append(pkgbuild.Nodes[:position], append([]*PkgbuildNode{node}, pkgbuild.Nodes[position:]...)...)
+}
+
+// returns true if the body of the function contains text
+func (pkgbuild *Pkgbuild) function_contains(name string, text string) bool {
+	node := pkgbuild.function(name)
+	return node != nil && strings.Contains(strings.Join(node.Lines, "\n"), text)
+}
+
+// appends lines to the end of a function, the function is created if it doesn't exist
+func (pkgbuild *Pkgbuild) append_to_function(name string, body []string) {
+	node := pkgbuild.function(name)
+	if node == nil {
+		pkgbuild.add_function(name, body)
+		return
+	}
+
+	indent := node.body_indent()
+	var indented []string
+	for _, line := range body {
+		indented = append(indented, indent+line)
+	}
+
+	last := node.Lines[len(node.Lines)-1]
+	index := strings.LastIndex(last, "}")
+	if strings.TrimSpace(last[:index]) == "" {
+		node.Lines = append(append(node.Lines[:len(node.Lines)-1], indented...), last)
+		return
+	}
+
+	// the closing brace follows code, e.g. prepare() { cd foo; }
+	header_indent := last[:len(last)-len(strings.TrimLeft(last, " \t"))]
+	node.Lines = append(append(node.Lines[:len(node.Lines)-1], strings.TrimRight(last[:index], " \t")), indented...)
+	node.Lines = append(node.Lines, header_indent+last[index:])
+}
+
+// inserts lines at the beginning of a function, the function is created if it doesn't exist
+func (pkgbuild *Pkgbuild) prepend_to_function(name string, body []string) {
+	node := pkgbuild.function(name)
+	if node == nil {
+		pkgbuild.add_function(name, body)
+		return
+	}
+
+	indent := node.body_indent()
+	var indented []string
+	for _, line := range body {
+		indented = append(indented, indent+line)
+	}
+
+	for index, line := range node.Lines {
+		brace := strings.Index(line, "{")
+		if brace < 0 {
+			continue
+		}
+		lines := append([]string{}, node.Lines[:index]...)
+		if rest := strings.TrimSpace(line[brace+1:]); rest != "" {
+			// code follows the opening brace, e.g. build() { make; }
+			lines = append(append(append(lines, line[:brace+1]), indented...), indent+rest)
+		} else {
+			lines = append(append(lines, line), indented...)
+		}
+		node.Lines = append(lines, node.Lines[index+1:]...)
+		return
+	}
+}
+
+// adds a new function in front of the existing functions, so that prepare() is placed before build() and package()
+func (pkgbuild *Pkgbuild) add_function(name string, body []string) {
+	node := &PkgbuildNode{Kind: pkgbuild_function, Name: name, Lines: []string{name + "() {"}}
+	for _, line := range body {
+		node.Lines = append(node.Lines, "  "+line)
+	}
+	node.Lines = append(node.Lines, "}")
+
+	for index, existing := range pkgbuild.Nodes {
+		if existing.Kind == pkgbuild_function {
+			pkgbuild.insert_node(index, &PkgbuildNode{Kind: pkgbuild_text, Lines: []string{""}})
+			pkgbuild.insert_node(index, node)
+			return
+		}
+	}
+	pkgbuild.Nodes = append(pkgbuild.Nodes, &PkgbuildNode{Kind: pkgbuild_text, Lines: []string{""}}, node)
+}
+
+// returns the first cd command in the body of the function
+func (pkgbuild *Pkgbuild) first_cd(name string) string {
+	node := pkgbuild.function(name)
+	if node == nil {
+		return ""
+	}
+	body := strings.Join(node.Lines, "\n")
+	body = body[strings.Index(body, "{")+1:]
+	for _, line := range strings.Split(body, "\n") {
+		for _, command := range command_separator_regex.Split(line, -1) {
+			command = strings.TrimSpace(command)
+			if strings.HasPrefix(command, "cd ") {
+				return command
+			}
+		}
+	}
+	return ""
+}
+
+// returns true for assignments with +=
+func (node *PkgbuildNode) is_append() bool {
+	match := variable_regex.FindStringSubmatch(node.Lines[0])
+	return match != nil && match[2] == "+="
+}
+
+// returns the shell code after the = of an assignment
+func (node *PkgbuildNode) value_text() string {
+	text := strings.Join(node.Lines, "\n")
+	return text[strings.Index(text, "=")+1:]
+}
+
+// returns true if the variable is assigned an array
+func (node *PkgbuildNode) is_array() bool {
+	return strings.HasPrefix(strings.TrimSpace(node.value_text()), "(")
+}
+
+// returns the shell code between the parentheses of an array assignment
+func (node *PkgbuildNode) array_text() string {
+	text := strings.TrimSpace(node.value_text())
+	if !strings.HasPrefix(text, "(") {
+		return text
+	}
+	text = text[1:]
+	if index := strings.LastIndex(text, ")"); index >= 0 {
+		text = text[:index]
+	}
+	return text
+}
+
+// returns the indentation of the values of a multi-line array
+func (node *PkgbuildNode) array_indent() string {
+	for _, line := range node.Lines[1:] {
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed != "" && trimmed != ")" {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return strings.Repeat(" ", len(node.Name)+2)
+}
+
+// returns the indentation of the body of a function
+func (node *PkgbuildNode) body_indent() string {
+	for _, line := range node.Lines[1:] {
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed != "" && trimmed != "}" && trimmed != "{" {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
+
+// splits shell code into words, quotes are kept and comments are removed
+func split_shell_words(text string) []string {
+	var words []string
+	var word strings.Builder
+	in_word := false
+	single, double, escaped := false, false, false
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case escaped:
+			word.WriteByte(c)
+			escaped = false
+		case single:
+			word.WriteByte(c)
+			single = c != '\''
+		case c == '\\':
+			word.WriteByte(c)
+			escaped = true
+			in_word = true
+		case double:
+			word.WriteByte(c)
+			double = c != '"'
+		case c == ' ' || c == '\t' || c == '\n':
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+		case c == '#' && !in_word:
+			// skip the comment up to the end of the line
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		default:
+			word.WriteByte(c)
+			in_word = true
+			single = c == '\''
+			double = c == '"'
+		}
+	}
+	if in_word {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// removes the quotes and escapes of a shell word, variables aren't expanded
+func unquote_shell_word(word string) string {
+	var unquoted strings.Builder
+	single, double := false, false
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case single:
+			if c == '\'' {
+				single = false
+			} else {
+				unquoted.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(word):
+			i++
+			unquoted.WriteByte(word[i])
+		case c == '"':
+			double = !double
+		case c == '\'' && !double:
+			single = true
+		default:
+			unquoted.WriteByte(c)
+		}
+	}
+	return unquoted.String()
+}
+
+// quotes a value in the same way as the existing word, e.g. with single quotes or unquoted.
+// values with variables or special characters are always quoted with double quotes
+func quote_shell_word_like(existing string, value string) string {
+	plain := plain_word_regex.MatchString(value)
+	switch {
+	case strings.HasPrefix(existing, "'") && !strings.ContainsAny(value, "'$"):
+		return "'" + value + "'"
+	case existing != "" && !strings.ContainsAny(existing[:1], `'"`) && plain:
+		return value
+	}
+	return quote_shell_word(value)
+}
+
+// quotes a value for a PKGBUILD with double quotes so that variables are still expanded
+func quote_shell_word(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+	return `"` + replacer.Replace(value) + `"`
+}
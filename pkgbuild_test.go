@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePkgbuild(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/wlroots0.17.PKGBUILD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		contents  string
+		functions []string
+		arrays    map[string][]string
+	}{
+		{
+			name:     "single line source",
+			contents: "pkgname=foo\nsource=(\"foo.tar.gz\" 'fix.patch')\nsha256sums=('abc' 'SKIP')\n",
+			arrays: map[string][]string{
+				"source":     {"foo.tar.gz", "fix.patch"},
+				"sha256sums": {"abc", "SKIP"},
+			},
+		},
+		{
+			name:     "architecture specific source",
+			contents: "source=(foo.tar.gz)\nsource_x86_64=(foo-x86_64.tar.gz)\nsource+=(extra.patch)\n",
+			arrays: map[string][]string{
+				"source":        {"foo.tar.gz", "extra.patch"},
+				"source_x86_64": {"foo-x86_64.tar.gz"},
+			},
+		},
+		{
+			name:      "indented closing brace",
+			contents:  "build() {\n  make\n  }\n\npackage() {\n  make install\n}\n",
+			functions: []string{"build", "package"},
+		},
+		{
+			name:      "nested braces",
+			contents:  "build() {\n  for f in ${files[@]}; do\n    { echo \"${f}}\"; } >> out\n  done\n}\npkgrel=1\n",
+			functions: []string{"build"},
+			arrays:    map[string][]string{"pkgrel": {"1"}},
+		},
+		{
+			name:      "fixture",
+			contents:  string(fixture),
+			functions: []string{"build", "package"},
+			arrays: map[string][]string{
+				"source":        {"${url}/-/releases/${pkgver}/downloads/wlroots-${pkgver}.tar.gz{,.sig}"},
+				"source_x86_64": {"prebuilt-${pkgver}.tar.gz"},
+				"sha256sums":    {"aaaaaaaa", "SKIP"},
+				"depends":       {"libinput", "libxkbcommon"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pkgbuild := parse_pkgbuild(test.contents)
+			if output := pkgbuild.String(); output != test.contents {
+				t.Errorf("String() changed the unmodified PKGBUILD:\n%s", output)
+			}
+
+			var functions []string
+			for _, node := range pkgbuild.Nodes {
+				if node.Kind == pkgbuild_function {
+					functions = append(functions, node.Name)
+				}
+			}
+			if !reflect.DeepEqual(functions, test.functions) {
+				t.Errorf("functions = %q, want %q", functions, test.functions)
+			}
+			for name, want := range test.arrays {
+				if values := pkgbuild.array(name); !reflect.DeepEqual(values, want) {
+					t.Errorf("array(%s) = %q, want %q", name, values, want)
+				}
+			}
+		})
+	}
+}
+
+func TestModifyPkgbuild(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/wlroots0.17.PKGBUILD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched_fixture, err := os.ReadFile("testdata/wlroots0.17.patched.PKGBUILD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		contents string
+		patch    PatchSpec
+		want     string
+	}{
+		{
+			name: "single line source",
+			contents: `pkgname=foo
+pkgver=1.0
+source=("https://example.org/foo-$pkgver.tar.gz")
+sha256sums=('abc')
+
+build() {
+  cd foo-$pkgver
+  make
+}
+`,
+			patch: PatchSpec{File: "fix.patch", Strip: 1},
+			want: `pkgname=foo
+pkgver=1.0
+source=("https://example.org/foo-$pkgver.tar.gz" "fix.patch")
+sha256sums=('abc' 'SKIP')
+
+prepare() {
+  cd "$srcdir"
+  cd foo-$pkgver
+  patch -Np1 -i "${srcdir}/fix.patch"
+}
+
+build() {
+  cd foo-$pkgver
+  make
+}
+`,
+		},
+		{
+			name: "architecture specific source",
+			contents: `pkgname=foo
+pkgver=1.0
+source=(foo-$pkgver.tar.gz)
+source_x86_64=(foo-bin-x86_64.tar.gz)
+sha256sums=(abc)
+sha256sums_x86_64=(def)
+
+prepare() {
+	cd foo-$pkgver
+	sed -i 's/a/b/' Makefile
+}
+`,
+			patch: PatchSpec{File: "fix.patch", Strip: 1},
+			want: `pkgname=foo
+pkgver=1.0
+source=(foo-$pkgver.tar.gz fix.patch)
+source_x86_64=(foo-bin-x86_64.tar.gz)
+sha256sums=(abc SKIP)
+sha256sums_x86_64=(def)
+
+prepare() {
+	cd foo-$pkgver
+	sed -i 's/a/b/' Makefile
+	cd "$srcdir"
+	cd foo-$pkgver
+	patch -Np1 -i "${srcdir}/fix.patch"
+}
+`,
+		},
+		{
+			name: "indented closing brace and nested braces",
+			contents: `pkgname=bar
+pkgver=2.0
+source=(
+  "https://example.org/bar-$pkgver.tar.gz"
+  "config.h"
+)
+b2sums=('aaa'
+        'bbb')
+
+prepare() {
+  cd bar-${pkgver}
+  for f in ${patches[@]}; do
+    { echo "$f"; } >> applied
+  done
+  }
+
+package() {
+  cd bar-${pkgver}
+  make DESTDIR="$pkgdir" install
+}
+`,
+			patch: PatchSpec{File: "nvidia.patch", Strip: 2, Dir: "render", Mode: "git"},
+			want: `pkgname=bar
+pkgver=2.0
+source=(
+  "https://example.org/bar-$pkgver.tar.gz"
+  "config.h"
+  "nvidia.patch"
+)
+b2sums=('aaa'
+        'bbb'
+        'SKIP')
+
+prepare() {
+  cd bar-${pkgver}
+  for f in ${patches[@]}; do
+    { echo "$f"; } >> applied
+  done
+  cd "$srcdir"
+  cd bar-${pkgver}
+  cd "render"
+  git apply -p2 "${srcdir}/nvidia.patch"
+  }
+
+package() {
+  cd bar-${pkgver}
+  make DESTDIR="$pkgdir" install
+}
+`,
+		},
+		{
+			name:     "fixture",
+			contents: string(fixture),
+			patch:    PatchSpec{File: "nvidia.patch", Strip: 1},
+			want:     string(patched_fixture),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// sources extracted by makepkg, used if neither prepare() nor build() change the directory
+			os.MkdirAll(filepath.Join(dir, "src", "wlroots-0.17.4"), os.FileMode(0755))
+			file := filepath.Join(dir, "PKGBUILD")
+			if err := os.WriteFile(file, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			modify_pkgbuild(file, test.patch, "wlroots0.17")
+			once, _ := os.ReadFile(file)
+			if string(once) != test.want {
+				t.Errorf("modify_pkgbuild() =\n%s\nwant\n%s", once, test.want)
+			}
+
+			// injecting the same patch again doesn't change the PKGBUILD
+			modify_pkgbuild(file, test.patch, "wlroots0.17")
+			twice, _ := os.ReadFile(file)
+			if string(twice) != string(once) {
+				t.Errorf("second modify_pkgbuild() changed the PKGBUILD:\n%s", twice)
+			}
+		})
+	}
+}
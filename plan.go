@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// changes of the installed packages and applications nompac applies in one run
+type Plan struct {
+	// selected package groups
+	Groups              []string
+	Packages_to_install []string
+	Packages_to_remove  []string
+	Flatpaks_to_install []FlatpakApp
+	Flatpaks_to_remove  []string
+	// installed applications whose commit differs from the pinned one
+	Flatpaks_to_pin []FlatpakApp
+	// managed files that are missing or differ from their sources
+	File_changes []FileChange
+	// systemd units whose state differs from the declared one
+	Service_changes []ServiceChange
+}
+
+// returns the package groups selected with -packagegroups or in the config file
+func selected_groups(configs Config, args Args) []string {
+	package_groups := configs.Packagegroups
+	if args.package_groups != "none" {
+		package_groups = args.package_groups
+	}
+
+	var groups []string
+	for _, group := range strings.Split(package_groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// returns true if the group is one of the selected groups or all groups are selected
+func group_selected(groups []string, group string) bool {
+	return contains(groups, group) || contains(groups, "all")
+}
+
+// compares the declared packages and applications of the selected groups with the installed ones
+func build_plan(configs Config, args Args) Plan {
+	groups := selected_groups(configs, args)
+	plan := Plan{Groups: groups}
+	plan.Packages_to_remove, plan.Packages_to_install = collect_package_lists(configs, groups)
+	plan_flatpaks(configs, groups, &plan)
+	plan.File_changes = file_changes(configs)
+	plan.Service_changes = service_changes(configs, groups)
+	return plan
+}
+
+// prints the changes of the plan
+func print_plan(plan Plan) {
+	var flatpaks_to_install []string
+	for _, app := range plan.Flatpaks_to_install {
+		flatpaks_to_install = append(flatpaks_to_install, app.ref())
+	}
+	var flatpaks_to_pin []string
+	for _, app := range plan.Flatpaks_to_pin {
+		flatpaks_to_pin = append(flatpaks_to_pin, app.Id+"@"+app.Commit)
+	}
+
+	fmt.Println(Blue + "Planned changes:" + Reset)
+	print_plan_entry("Packages to install", plan.Packages_to_install)
+	print_plan_entry("Packages to remove", plan.Packages_to_remove)
+	print_plan_entry("Flatpaks to install", flatpaks_to_install)
+	print_plan_entry("Flatpaks to remove", plan.Flatpaks_to_remove)
+	print_plan_entry("Flatpaks to pin", flatpaks_to_pin)
+	for _, change := range plan.File_changes {
+		fmt.Printf("  File %s: %s\n", change.Target, strings.Join(change.Differences, ", "))
+	}
+	for _, change := range plan.Service_changes {
+		fmt.Printf("  Unit %s: %s -> %s\n", change.Service, change.Current, strings.Join(change.Actions, ", "))
+	}
+}
+
+func print_plan_entry(title string, entries []string) {
+	if len(entries) == 0 {
+		return
+	}
+	sorted := append([]string{}, entries...)
+	sort.Strings(sorted)
+	fmt.Printf("  %s: %s\n", title, strings.Join(sorted, " "))
+}
+
+// removes and installs the packages of the plan, upgrades the system and applies the file, flatpak and unit changes
+func apply_plan(configs Config, plan Plan) {
+	// only perform if packages have to be removed
+	if len(plan.Packages_to_remove) > 0 {
+		fmt.Println(Red + "Removing the following packages since they don't exist in the config file:" + Reset)
+		// TODO: change to async
+		fmt.Println(" " + strings.Join(plan.Packages_to_remove, " "))
+		configs.Manager.remove(plan.Packages_to_remove)
+	}
+
+	// only perform if packages have to be installed
+	if len(plan.Packages_to_install) > 0 {
+		fmt.Println(Blue + "Installing the following packages and starting update:" + Reset)
+		//TODO: change to async
+		fmt.Println(" " + strings.Join(plan.Packages_to_install, " "))
+		configs.Manager.upgrade(configs, plan.Packages_to_install)
+	} else {
+		fmt.Println(Blue + "Starting system update.\n" + Reset)
+		//TODO: change to async
+		configs.Manager.upgrade(configs, nil)
+	}
+
+	// the managed files are installed after the packages that create their directories
+	apply_files(configs, plan.File_changes)
+	// after running the update, check for changed config files
+	check_config_backups(configs)
+
+	apply_flatpaks(configs, plan)
+	apply_services(configs, plan.Groups)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// entry of the database of a pacman repository, read from the desc-files
+type RepoEntry struct {
+	Filename string
+	Name     string
+	Version  string
+	Sha256   string
+	Depends  []string
+	Provides []string
+}
+
+// package file in the local repository directory
+type PackageFile struct {
+	Path    string
+	Name    string
+	Version string
+	Size    int64
+}
+
+// matches package files like wlroots0.17-0.17.4-2-x86_64.pkg.tar.zst
+var package_file_regex = regexp.MustCompile(`^(.+)-([^-]+-[^-]+)-([^-]+)\.pkg\.tar(\.[a-z0-9]+)?$`)
+
+// handles "nompac repo <subcommand>"
+func repo_command(config Config, command []string) {
+	if len(command) == 0 {
+		fmt.Println(Red + "Missing repo command. Available: gc, verify" + Reset)
+		os.Exit(2)
+	}
+
+	if config.Local_repo == "none" {
+		fmt.Println(Red + "No local repository configured." + Reset)
+		os.Exit(1)
+	}
+	if config.Manager.name() != "pacman" {
+		fmt.Println(Red + "repo commands only support the local repository of pacman." + Reset)
+		os.Exit(1)
+	}
+
+	switch command[0] {
+	case "gc":
+		flags := flag.NewFlagSet("repo gc", flag.ExitOnError)
+		keep := flags.Int("keep", config.Repo_keep, "Number of versions of each declared package that are kept for rollbacks.")
+		dry_run := flags.Bool("dry-run", false, "Only report what would be removed.")
+		flags.Parse(command[1:])
+		repo_gc(config, *keep, *dry_run)
+	case "verify":
+		if !repo_verify(config) {
+			os.Exit(1)
+		}
+	default:
+		fmt.Println(Red + "Unknown repo command: " + command[0] + Reset)
+		os.Exit(2)
+	}
+}
+
+// returns the names of all packages that nompac builds into the local repository
+// including the packages of split PKGBUILDs recorded in the lockfile
+func declared_packages(config Config) map[string]bool {
+	lock := read_lockfile(config)
+	declared := map[string]bool{}
+
+	add := func(pkg string) {
+		declared[pkg] = true
+		for _, name := range lock.Packages[pkg].Packages {
+			declared[name] = true
+		}
+	}
+	for _, pkg := range config.Overlays {
+		if name, is_aur := aur_name(pkg); is_aur {
+			pkg = name
+		}
+		add(pkg)
+	}
+	for pkg := range upstream_packages(config) {
+		add(pkg)
+	}
+	for pkg := range config.Package_snapshots {
+		add(pkg)
+	}
+	// packages from the AUR are locked by pkgbase, which doesn't have to be the declared name
+	for pkg, locked := range lock.Packages {
+		for _, name := range locked.Packages {
+			if declared[name] && !declared[pkg] {
+				add(pkg)
+			}
+		}
+	}
+	// dependencies from the AUR or of cherry-picked packages are kept as long as the package that needs them is declared
+	for pkg, locked := range lock.Packages {
+		if locked.Required_by != "" && declared[locked.Required_by] {
+			add(pkg)
+		}
+	}
+	return declared
+}
+
+// reads the entries of a repository database (db.tar.zst) with bsdtar since go can't decompress zstd
+func read_repo_db(db_file string) ([]RepoEntry, error) {
+	output, err := exec.Command("bsdtar", "-xOf", db_file, "*/desc").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository database %s: %w", db_file, err)
+	}
+	return parse_desc_entries(bytes.NewReader(output)), nil
+}
+
+// parses concatenated desc-files of a repository database.
+// every desc-file starts with the %FILENAME% field
+func parse_desc_entries(contents io.Reader) []RepoEntry {
+	var entries []RepoEntry
+	field := ""
+
+	scanner := bufio.NewScanner(contents)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			field = ""
+			continue
+		}
+		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			field = line
+			if field == "%FILENAME%" {
+				entries = append(entries, RepoEntry{})
+			}
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		entry := &entries[len(entries)-1]
+		switch field {
+		case "%FILENAME%":
+			entry.Filename = line
+		case "%NAME%":
+			entry.Name = line
+		case "%VERSION%":
+			entry.Version = line
+		case "%SHA256SUM%":
+			entry.Sha256 = line
+		case "%DEPENDS%":
+			entry.Depends = append(entry.Depends, line)
+		case "%PROVIDES%":
+			entry.Provides = append(entry.Provides, line)
+		}
+	}
+	return entries
+}
+
+// lists all package files in the directory of the local repository
+func list_package_files(repo_dir string) []PackageFile {
+	var package_files []PackageFile
+
+	entries, err := os.ReadDir(repo_dir)
+	if err != nil {
+		fmt.Printf("Couldn't read repository directory %s: %s\n", repo_dir, err)
+		return package_files
+	}
+
+	for _, entry := range entries {
+		match := package_file_regex.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		package_files = append(package_files, PackageFile{
+			Path:    filepath.Join(repo_dir, entry.Name()),
+			Name:    match[1],
+			Version: match[2],
+			Size:    info.Size(),
+		})
+	}
+	return package_files
+}
+
+// removes packages from the local repository that are no longer declared in the config,
+// deletes all but the newest keep versions of each package file and orphaned signature files
+// and reports the reclaimed space
+func repo_gc(config Config, keep int, dry_run bool) {
+	db_file := config.Local_repo_path
+	repo_dir := filepath.Dir(db_file)
+	declared := declared_packages(config)
+
+	entries, err := read_repo_db(db_file)
+	if err != nil {
+		fmt.Println(Red + err.Error() + Reset)
+		return
+	}
+
+	// remove database entries of packages that are no longer declared
+	var undeclared []string
+	current_files := map[string]bool{}
+	for _, entry := range entries {
+		if declared[entry.Name] {
+			current_files[entry.Filename] = true
+		} else {
+			undeclared = append(undeclared, entry.Name)
+		}
+	}
+	if len(undeclared) > 0 {
+		fmt.Println(Yellow + "Removing database entries of undeclared packages:" + Reset)
+		fmt.Println(strings.Join(undeclared, " "))
+		if !dry_run {
+			config.Manager.remove_from_local_repo(config, undeclared)
+		}
+	}
+
+	// group the package files by package and sort them from newest to oldest
+	versions := map[string][]PackageFile{}
+	for _, package_file := range list_package_files(repo_dir) {
+		versions[package_file.Name] = append(versions[package_file.Name], package_file)
+	}
+
+	var reclaimed int64
+	var to_delete []string
+	for name, files := range versions {
+		sort.Slice(files, func(i, j int) bool {
+			return vercmp(files[i].Version, files[j].Version) > 0
+		})
+
+		kept := 0
+		for _, package_file := range files {
+			// the file referenced by the database is always kept
+			if declared[name] && (kept < keep || current_files[filepath.Base(package_file.Path)]) {
+				kept++
+				continue
+			}
+			to_delete = append(to_delete, package_file.Path)
+			reclaimed += package_file.Size
+			if info, err := os.Stat(package_file.Path + ".sig"); err == nil {
+				to_delete = append(to_delete, package_file.Path+".sig")
+				reclaimed += info.Size()
+			}
+		}
+	}
+
+	// signature files without a package file
+	signatures, _ := filepath.Glob(filepath.Join(repo_dir, "*.pkg.tar*.sig"))
+	for _, signature := range signatures {
+		package_path := strings.TrimSuffix(signature, ".sig")
+		if _, err := os.Stat(package_path); err == nil || contains(to_delete, signature) {
+			continue
+		}
+		if info, err := os.Stat(signature); err == nil {
+			to_delete = append(to_delete, signature)
+			reclaimed += info.Size()
+		}
+	}
+
+	sort.Strings(to_delete)
+	for _, file := range to_delete {
+		fmt.Println("Removing " + filepath.Base(file))
+		if dry_run {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			fmt.Printf(Red+"Couldn't remove %s: %s\n"+Reset, file, err)
+		}
+	}
+
+	if dry_run {
+		fmt.Println(Green + "Would reclaim " + human_size(reclaimed) + Reset)
+	} else {
+		fmt.Println(Green + "Reclaimed " + human_size(reclaimed) + Reset)
+	}
+}
+
+// formats a size in bytes in a human readable way
+func human_size(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// returns the flags for repo-add and repo-remove to sign the database with the configured key
+func repo_add_sign_flags(config Config) string {
+	if config.Sign_key == "" {
+		return ""
+	}
+	return fmt.Sprintf("--sign --key %s --verify ", config.Sign_key)
+}
+
+// creates a detached signature <file>.sig with the configured key
+func sign_file(config Config, file string) error {
+	cmd := exec.Command("gpg", "--batch", "--yes", "--detach-sign", "--no-armor", "--local-user", config.Sign_key, "--output", file+".sig", file)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to sign %s: %w", file, err)
+	}
+	return nil
+}
+
+// checks a detached signature with gpg
+func verify_signature(file string, signature string) error {
+	output, err := exec.Command("gpg", "--batch", "--verify", signature, file).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// imports the signing key into the pacman keyring and signs it locally,
+// otherwise pacman refuses packages from the local repository with SigLevel = Required
+func trust_sign_key(config Config) {
+	fmt.Println("Adding signing key " + config.Sign_key + " to the pacman keyring.")
+	execCmd(fmt.Sprintf("gpg --export %s | sudo pacman-key --add - && sudo pacman-key --lsign-key %s", config.Sign_key, config.Sign_key))
+}
+
+// verifies the signatures of the repository database and all package files of the local repository.
+// returns false if a signature is missing or invalid
+func repo_verify(config Config) bool {
+	db_file := config.Local_repo_path
+	files := []string{db_file}
+	for _, package_file := range list_package_files(filepath.Dir(db_file)) {
+		files = append(files, package_file.Path)
+	}
+
+	valid := true
+	for _, file := range files {
+		signature := file + ".sig"
+		if _, err := os.Stat(signature); err != nil {
+			fmt.Println(Red + "Missing signature: " + filepath.Base(file) + Reset)
+			valid = false
+			continue
+		}
+		if err := verify_signature(file, signature); err != nil {
+			fmt.Println(Red + "Invalid signature: " + filepath.Base(file) + Reset)
+			fmt.Println(err.Error())
+			valid = false
+			continue
+		}
+		fmt.Println(Green + "Valid signature: " + filepath.Base(file) + Reset)
+	}
+
+	if valid {
+		fmt.Printf(Green+"All %d signatures are valid.\n"+Reset, len(files))
+	}
+	return valid
+}
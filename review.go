@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// directory in the state directory that holds the unpatched upstream files of the last built version
+func upstream_snapshot_dir(config Config, packagename string) string {
+	return filepath.Join(config.State_dir, "upstream", packagename)
+}
+
+// directory holding the upstream files of the version that is currently built
+func staged_snapshot_dir(config Config, packagename string) string {
+	return filepath.Join(config.State_dir, "upstream", ".staged", packagename)
+}
+
+// shows the differences of the upstream PKGBUILD and auxiliary files between the last built version
+// and the new version in pkg_build_dir.
+// returns false if the build should be skipped because the changes weren't approved
+func review_upstream_changes(config Config, args Args, packagename string, packageversion string, pkg_build_dir string) bool {
+	old_dir := upstream_snapshot_dir(config, packagename)
+
+	if _, err := os.Stat(old_dir); err != nil {
+		fmt.Println(Yellow + "No upstream files of a previous build of " + packagename + " recorded." + Reset)
+		if !config.Review_upstream {
+			return true
+		}
+		return ask_approval(args, fmt.Sprintf("Build %s %s without a previous version to compare to?", packagename, packageversion))
+	}
+
+	old_version, _ := os.ReadFile(old_dir + ".version")
+
+	// diff exits with 1 if the directories differ and with 2 on errors
+	output, err := exec.Command("diff", "-ruN", "--exclude=.SRCINFO", old_dir, pkg_build_dir).Output()
+	if err == nil {
+		fmt.Println(Green + "No upstream changes of " + packagename + " since the last build." + Reset)
+		return true
+	}
+	if exit_error, ok := err.(*exec.ExitError); !ok || exit_error.ExitCode() != 1 {
+		fmt.Printf(Red+"Couldn't compare upstream files of %s: %s\n"+Reset, packagename, err)
+		return !config.Review_upstream
+	}
+
+	fmt.Printf(Blue+"\nUpstream changes of %s from %s to %s:\n"+Reset, packagename, strings.TrimSpace(string(old_version)), packageversion)
+	fmt.Println(string(output))
+
+	if !config.Review_upstream {
+		return true
+	}
+	return ask_approval(args, fmt.Sprintf("Apply the patches and build %s %s?", packagename, packageversion))
+}
+
+// keeps a copy of the unpatched upstream files until the build succeeded
+func stage_upstream_snapshot(config Config, packagename string, packageversion string, pkg_build_dir string) {
+	staged_dir := staged_snapshot_dir(config, packagename)
+	os.RemoveAll(staged_dir)
+
+	if err := copy_dir(pkg_build_dir, staged_dir); err != nil {
+		fmt.Printf("Couldn't save upstream files of %s: %s\n", packagename, err)
+		return
+	}
+	os.WriteFile(staged_dir+".version", []byte(packageversion+"\n"), 0644)
+}
+
+// replaces the upstream files of the last build with the staged ones after a successful build
+func commit_upstream_snapshot(config Config, packagename string) {
+	staged_dir := staged_snapshot_dir(config, packagename)
+	snapshot_dir := upstream_snapshot_dir(config, packagename)
+
+	if _, err := os.Stat(staged_dir); err != nil {
+		return
+	}
+
+	os.RemoveAll(snapshot_dir)
+	if err := os.Rename(staged_dir, snapshot_dir); err != nil {
+		fmt.Printf("Couldn't save upstream files of %s: %s\n", packagename, err)
+		return
+	}
+	os.Rename(staged_dir+".version", snapshot_dir+".version")
+}
+
+// returns true if nompac runs in a terminal and can ask questions
+func is_interactive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// asks the user to approve a change.
+// In non-interactive runs, changes are only approved with the -accept flag
+func ask_approval(args Args, question string) bool {
+	if args.accept {
+		return true
+	}
+	if !is_interactive() {
+		fmt.Println(Yellow + "Approval required. Rerun with -accept to accept the changes." + Reset)
+		return false
+	}
+
+	fmt.Print(question + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
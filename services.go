@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// systemd unit whose state is declared in the config, given as unit name or as object
+type Service struct {
+	Unit string `json:"unit"`
+	// unit of the user manager (systemctl --user) instead of the system manager
+	User bool `json:"user"`
+	// "enabled" (default), "disabled" or "masked"
+	State string `json:"state"`
+	// start the unit if it isn't running, only for enabled units
+	Start bool `json:"start"`
+}
+
+// change of a unit that nompac applies
+type ServiceChange struct {
+	Service Service
+	// current state from systemctl is-enabled, "not-found" if the unit doesn't exist yet
+	Current string
+	// systemctl commands, e.g. "unmask", "enable", "start"
+	Actions []string
+}
+
+// accepts either a unit name or an object
+func (service *Service) UnmarshalJSON(data []byte) error {
+	var unit string
+	if err := json.Unmarshal(data, &unit); err == nil {
+		*service = Service{Unit: unit_name(unit), State: "enabled"}
+		return nil
+	}
+
+	type plain Service
+	object := plain{State: "enabled"}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	if object.Unit == "" {
+		return fmt.Errorf("service without unit")
+	}
+	if object.State != "enabled" && object.State != "disabled" && object.State != "masked" {
+		return fmt.Errorf("unknown state %s of %s, use enabled, disabled or masked", object.State, object.Unit)
+	}
+	object.Unit = unit_name(object.Unit)
+	*service = Service(object)
+	return nil
+}
+
+// units without type are services like in systemctl, e.g. firewalld becomes firewalld.service
+func unit_name(unit string) string {
+	if unit == "" || strings.Contains(unit, ".") {
+		return unit
+	}
+	return unit + ".service"
+}
+
+func (service Service) systemctl() string {
+	if service.User {
+		return "systemctl --user"
+	}
+	return "sudo systemctl"
+}
+
+// returns systemctl for queries, which don't need root
+func (service Service) query() string {
+	if service.User {
+		return "systemctl --user"
+	}
+	return "systemctl"
+}
+
+func (service Service) String() string {
+	if service.User {
+		return service.Unit + " (user)"
+	}
+	return service.Unit
+}
+
+// returns the declared units of the selected package groups, later declarations of a unit win
+func declared_services(config Config, groups []string) []Service {
+	var services []Service
+	index := map[string]int{}
+	for _, group := range sorted_keys(config.Services) {
+		if !group_selected(groups, group) {
+			continue
+		}
+		for _, service := range config.Services[group] {
+			key := service.String()
+			if i, ok := index[key]; ok {
+				services[i] = service
+				continue
+			}
+			index[key] = len(services)
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// returns the state of the unit file from systemctl is-enabled, e.g. enabled, disabled, masked or static.
+// Unlike list-unit-files, is-enabled also knows instances of template units like getty@tty2.service
+func unit_state(config Config, service Service) string {
+	// is-enabled exits with an error for all states but enabled, the output still contains the state
+	output, _ := config.Runner.output(service.query() + " is-enabled " + service.Unit)
+	if fields := strings.Fields(string(output)); len(fields) > 0 {
+		return fields[0]
+	}
+	return "not-found"
+}
+
+func unit_active(config Config, service Service) bool {
+	_, err := config.Runner.output(service.query() + " is-active --quiet " + service.Unit)
+	return err == nil
+}
+
+// compares the declared units with the state of their unit files
+func service_changes(config Config, groups []string) []ServiceChange {
+	var changes []ServiceChange
+	for _, service := range declared_services(config, groups) {
+		current := unit_state(config, service)
+
+		var actions []string
+		switch service.State {
+		case "enabled":
+			if current == "masked" {
+				actions = append(actions, "unmask")
+			}
+			// static units can't be enabled, they are started by other units
+			if current != "enabled" && current != "static" && current != "alias" {
+				actions = append(actions, "enable")
+			}
+			if service.Start && !unit_active(config, service) {
+				actions = append(actions, "start")
+			}
+		case "disabled":
+			if current == "masked" {
+				actions = append(actions, "unmask")
+			}
+			if current == "enabled" {
+				actions = append(actions, "disable")
+			}
+		case "masked":
+			if current != "masked" {
+				actions = append(actions, "mask")
+			}
+		}
+		if len(actions) > 0 {
+			changes = append(changes, ServiceChange{Service: service, Current: current, Actions: actions})
+		}
+	}
+	return changes
+}
+
+// applies the declared unit states. The states are compared again since the installed packages can add units
+func apply_services(config Config, groups []string) {
+	changes := service_changes(config, groups)
+	if len(changes) == 0 {
+		return
+	}
+
+	fmt.Println(Blue + "Applying the declared states of systemd units:" + Reset)
+	for _, change := range changes {
+		// units can be masked before they exist, e.g. to keep a package from starting its service
+		if change.Current == "not-found" && change.Service.State != "masked" {
+			fmt.Println(Yellow + "Unit " + change.Service.String() + " doesn't exist, is the package providing it installed?" + Reset)
+			continue
+		}
+		for _, action := range change.Actions {
+			command := change.Service.systemctl() + " " + action + " " + change.Service.Unit
+			if err := config.Runner.run(command); err != nil {
+				fmt.Printf(Red+"Couldn't %s %s: %s\n"+Reset, action, change.Service, err)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServiceChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		service Service
+		outputs map[string]string
+		current string
+		actions []string
+	}{
+		{
+			name:    "enabled unit",
+			service: Service{Unit: "sshd.service", State: "enabled"},
+			outputs: map[string]string{"systemctl is-enabled sshd.service": "enabled\n"},
+		},
+		{
+			name:    "disabled unit is enabled",
+			service: Service{Unit: "sshd.service", State: "enabled"},
+			outputs: map[string]string{"systemctl is-enabled sshd.service": "disabled\n"},
+			current: "disabled",
+			actions: []string{"enable"},
+		},
+		{
+			name:    "instance of a template unit",
+			service: Service{Unit: "wg-quick@wg0.service", State: "enabled"},
+			outputs: map[string]string{"systemctl is-enabled wg-quick@wg0.service": "disabled\n"},
+			current: "disabled",
+			actions: []string{"enable"},
+		},
+		{
+			name:    "masked unit is unmasked and enabled",
+			service: Service{Unit: "sshd.service", State: "enabled"},
+			outputs: map[string]string{"systemctl is-enabled sshd.service": "masked\n"},
+			current: "masked",
+			actions: []string{"unmask", "enable"},
+		},
+		{
+			name:    "static unit can't be enabled",
+			service: Service{Unit: "systemd-udevd.service", State: "enabled"},
+			outputs: map[string]string{"systemctl is-enabled systemd-udevd.service": "static\n"},
+		},
+		{
+			name:    "missing unit",
+			service: Service{Unit: "foo.service", State: "enabled"},
+			current: "not-found",
+			actions: []string{"enable"},
+		},
+		{
+			name:    "inactive unit is started",
+			service: Service{Unit: "sshd.service", State: "enabled", Start: true},
+			outputs: map[string]string{"systemctl is-enabled sshd.service": "enabled\n"},
+			current: "enabled",
+			actions: []string{"start"},
+		},
+		{
+			name:    "active unit",
+			service: Service{Unit: "sshd.service", State: "enabled", Start: true},
+			outputs: map[string]string{"systemctl is-enabled sshd.service": "enabled\n", "systemctl is-active --quiet sshd.service": ""},
+		},
+		{
+			name:    "enabled unit is disabled",
+			service: Service{Unit: "getty@tty2.service", State: "disabled"},
+			outputs: map[string]string{"systemctl is-enabled getty@tty2.service": "enabled\n"},
+			current: "enabled",
+			actions: []string{"disable"},
+		},
+		{
+			name:    "masked unit is unmasked",
+			service: Service{Unit: "sshd.service", State: "disabled"},
+			outputs: map[string]string{"systemctl is-enabled sshd.service": "masked\n"},
+			current: "masked",
+			actions: []string{"unmask"},
+		},
+		{
+			name:    "missing unit is masked",
+			service: Service{Unit: "foo.service", State: "masked"},
+			current: "not-found",
+			actions: []string{"mask"},
+		},
+		{
+			name:    "user unit",
+			service: Service{Unit: "pipewire.socket", User: true, State: "enabled"},
+			outputs: map[string]string{"systemctl --user is-enabled pipewire.socket": "disabled\n"},
+			current: "disabled",
+			actions: []string{"enable"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{
+				Services: map[string][]Service{"base": {test.service}},
+				Runner:   &recording_runner{outputs: test.outputs},
+			}
+
+			changes := service_changes(config, []string{"base"})
+			var want []ServiceChange
+			if len(test.actions) > 0 {
+				want = []ServiceChange{{Service: test.service, Current: test.current, Actions: test.actions}}
+			}
+			if !reflect.DeepEqual(changes, want) {
+				t.Errorf("service_changes() = %+v, want %+v", changes, want)
+			}
+		})
+	}
+}
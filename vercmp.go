@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// compares two package versions in the format [epoch:]version[-release] the same way pacman's vercmp does.
+// returns -1 if a is older than b, 0 if both are equal and 1 if a is newer than b
+func vercmp(a string, b string) int {
+	if a == b {
+		return 0
+	}
+
+	epoch_a, version_a, release_a := parse_evr(a)
+	epoch_b, version_b, release_b := parse_evr(b)
+
+	result := rpmvercmp(epoch_a, epoch_b)
+	if result == 0 {
+		result = rpmvercmp(version_a, version_b)
+		// the release is only compared if both versions contain one
+		if result == 0 && release_a != "" && release_b != "" {
+			result = rpmvercmp(release_a, release_b)
+		}
+	}
+	return result
+}
+
+// splits a version string into epoch, version and release
+func parse_evr(evr string) (string, string, string) {
+	epoch := "0"
+	version := evr
+	release := ""
+
+	if index := strings.Index(version, ":"); index > 0 && strings.Trim(version[:index], "0123456789") == "" {
+		epoch = version[:index]
+		version = version[index+1:]
+	}
+	if index := strings.LastIndex(version, "-"); index >= 0 {
+		release = version[index+1:]
+		version = version[:index]
+	}
+	return epoch, version, release
+}
+
+// port of the segment-wise comparison of libalpm.
+// numeric segments are compared as numbers and are always newer than alphabetic segments
+func rpmvercmp(a string, b string) int {
+	if a == b {
+		return 0
+	}
+
+	is_alnum := func(c byte) bool {
+		return unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+	}
+	is_digit := func(c byte) bool {
+		return c >= '0' && c <= '9'
+	}
+	is_alpha := func(c byte) bool {
+		return unicode.IsLetter(rune(c))
+	}
+
+	one, two := 0, 0
+	for one < len(a) && two < len(b) {
+		start_one, start_two := one, two
+		for one < len(a) && !is_alnum(a[one]) {
+			one++
+		}
+		for two < len(b) && !is_alnum(b[two]) {
+			two++
+		}
+
+		// if we ran to the end of either, we are finished with the loop
+		if one >= len(a) || two >= len(b) {
+			break
+		}
+
+		// if the separator lengths were different, we are also finished
+		if one-start_one != two-start_two {
+			if one-start_one < two-start_two {
+				return -1
+			}
+			return 1
+		}
+
+		end_one, end_two := one, two
+		is_number := is_digit(a[one])
+		if is_number {
+			for end_one < len(a) && is_digit(a[end_one]) {
+				end_one++
+			}
+			for end_two < len(b) && is_digit(b[end_two]) {
+				end_two++
+			}
+		} else {
+			for end_one < len(a) && is_alpha(a[end_one]) {
+				end_one++
+			}
+			for end_two < len(b) && is_alpha(b[end_two]) {
+				end_two++
+			}
+		}
+
+		segment_one := a[one:end_one]
+		segment_two := b[two:end_two]
+
+		// segments of different types: numeric segments are newer than alpha segments
+		if segment_two == "" {
+			if is_number {
+				return 1
+			}
+			return -1
+		}
+
+		if is_number {
+			segment_one = strings.TrimLeft(segment_one, "0")
+			segment_two = strings.TrimLeft(segment_two, "0")
+
+			// the longer number is newer
+			if len(segment_one) > len(segment_two) {
+				return 1
+			}
+			if len(segment_one) < len(segment_two) {
+				return -1
+			}
+		}
+
+		if result := strings.Compare(segment_one, segment_two); result != 0 {
+			return result
+		}
+
+		one, two = end_one, end_two
+	}
+
+	if one >= len(a) && two >= len(b) {
+		return 0
+	}
+
+	// the version with a remaining alpha segment is older, e.g. 1.0alpha < 1.0
+	if (one >= len(a) && !is_alpha(b[two])) || (one < len(a) && is_alpha(a[one])) {
+		return -1
+	}
+	return 1
+}
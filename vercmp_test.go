@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+// cases of the vercmp test suite of pacman
+func TestVercmp(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		// same length, no pkgrel
+		{"1.5.0", "1.5.0", 0},
+		{"1.5.1", "1.5.0", 1},
+		// mixed length
+		{"1.5.1", "1.5", 1},
+		{"1.0", "1.0.0", -1},
+		{"1.001", "1.1", 0},
+		// pkgrel
+		{"1.5.0-1", "1.5.0-1", 0},
+		{"1.5.0-1", "1.5.0-2", -1},
+		{"1.5.0-1", "1.5.1-1", -1},
+		{"1.5.0-2", "1.5.1-1", -1},
+		{"1.5-1", "1.5.1-1", -1},
+		{"1.5-2", "1.5.1-2", -1},
+		{"0.17.4-2", "0.17.4-2.1", -1},
+		{"0.17.4-2.1", "0.17.4-3", -1},
+		// pkgrel is only compared if both versions have one
+		{"1.5", "1.5-1", 0},
+		{"1.5-1", "1.5", 0},
+		{"1.0-1", "1.1", -1},
+		{"1.1-1", "1.0", 1},
+		// alphanumeric versions
+		{"1.0a", "1.0", -1},
+		{"1.5b-1", "1.5-1", -1},
+		{"1.5b", "1.5.1", -1},
+		{"1.0a", "1.0alpha", -1},
+		{"1.0alpha", "1.0b", -1},
+		{"1.0b", "1.0beta", -1},
+		{"1.0beta", "1.0rc", -1},
+		{"1.0rc", "1.0", -1},
+		// alpha-dotted versions
+		{"1.5.a", "1.5", 1},
+		{"1.5.b", "1.5.a", 1},
+		{"1.5.1", "1.5.b", 1},
+		{"1.5.b-1", "1.5.b", 0},
+		{"1.5-1", "1.5.b", -1},
+		// separators
+		{"2.0", "2_0", 0},
+		{"2.0_a", "2_0.a", 0},
+		{"2.0a", "2.0.a", -1},
+		{"2___a", "2_a", 1},
+		// epochs
+		{"0:1.0", "0:1.0", 0},
+		{"0:1.0", "0:1.1", -1},
+		{"1:1.0", "0:1.0", 1},
+		{"1:1.0", "0:1.1", 1},
+		{"1:1.0", "2:1.1", -1},
+		{"1:1.0", "0:1.0-1", 1},
+		{"1:1.0-1", "0:1.1-1", 1},
+		{"0:1.0", "1.0", 0},
+		{"0:1.1", "1.0", 1},
+		{"0:1.1", "1:1.0", -1},
+		{"1:1.0", "1.1", 1},
+	}
+
+	for _, test := range tests {
+		if result := vercmp(test.a, test.b); result != test.want {
+			t.Errorf("vercmp(%s, %s) = %d, want %d", test.a, test.b, result, test.want)
+		}
+		// swapping the versions inverts the result
+		if result := vercmp(test.b, test.a); result != -test.want {
+			t.Errorf("vercmp(%s, %s) = %d, want %d", test.b, test.a, result, -test.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// zypper keeps the packages that were installed as dependency in this file
+var zypper_auto_installed = "/var/lib/zypp/AutoInstalled"
+
+// alias of the repository that points to the configured snapshot of openSUSE Tumbleweed
+const zypper_snapshot_alias = "nompac-snapshot"
+
+// zypper with a local rpm-md repository managed by createrepo_c.
+// The local repository is the directory of local_repo, its alias is the file name without .db.tar.zst
+type zypper_manager struct {
+	runner CommandRunner
+}
+
+func (manager *zypper_manager) name() string {
+	return "zypper"
+}
+
+func (manager *zypper_manager) query_installed(packagename string) string {
+	output, err := manager.runner.output("rpm -q --qf '%{EPOCH}:%{VERSION}-%{RELEASE}' " + packagename)
+	if err != nil {
+		return ""
+	}
+	// rpm prints (none) for packages without epoch
+	return strings.TrimPrefix(strings.TrimSpace(string(output)), "(none):")
+}
+
+// rpm doesn't know which packages were installed explicitly, zypper records the others in AutoInstalled
+func (manager *zypper_manager) query_explicit() ([]string, error) {
+	output, err := manager.runner.output("rpm -qa --qf '%{NAME}\\n'")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get list of installed packages: %w", err)
+	}
+
+	auto_installed := map[string]bool{}
+	if file, err := os.Open(zypper_auto_installed); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				auto_installed[line] = true
+			}
+		}
+		file.Close()
+	}
+
+	var explicit []string
+	for _, pkg := range strings.Fields(string(output)) {
+		// gpg-pubkey entries are the keys of the rpm database
+		if !auto_installed[pkg] && pkg != "gpg-pubkey" && !contains(explicit, pkg) {
+			explicit = append(explicit, pkg)
+		}
+	}
+	return explicit, nil
+}
+
+func (manager *zypper_manager) install_local(package_files []string, as_deps bool) error {
+	// zypper has no option to install packages as dependency, they are installed like the declared packages
+	return manager.runner.run("sudo zypper --non-interactive install --allow-unsigned-rpm " + strings.Join(package_files, " "))
+}
+
+func (manager *zypper_manager) remove(packages []string) error {
+	return manager.runner.run("sudo zypper --non-interactive remove --clean-deps " + strings.Join(packages, " "))
+}
+
+func (manager *zypper_manager) upgrade(config Config, install []string) error {
+	// dist-upgrade asks for confirmation like pacman -Syu, since it can replace or remove packages of the system
+	if err := manager.runner.run("sudo zypper --non-interactive refresh && sudo zypper dist-upgrade"); err != nil {
+		return err
+	}
+	if len(install) == 0 {
+		return nil
+	}
+	return manager.runner.run("sudo zypper --non-interactive install " + strings.Join(install, " "))
+}
+
+// openSUSE keeps the repository of every Tumbleweed snapshot in the history of download.opensuse.org.
+// In rolling mode, the snapshot repository is removed
+func (manager *zypper_manager) set_snapshot(config Config, date []string) error {
+	if len(config.Repo_snapshots) > 0 {
+		fmt.Println(Yellow + "repo_snapshots are only supported with pacman, all repositories use the snapshot." + Reset)
+	}
+	if date == nil {
+		return manager.runner.run(fmt.Sprintf("sudo zypper --non-interactive removerepo %s >/dev/null 2>&1 || true", zypper_snapshot_alias))
+	}
+	url := fmt.Sprintf("https://download.opensuse.org/history/%s%s%s/tumbleweed/repo/oss/", date[0], date[1], date[2])
+	return manager.runner.run(fmt.Sprintf(
+		"sudo zypper --non-interactive removerepo %s >/dev/null 2>&1; sudo zypper --non-interactive addrepo --refresh %s %s",
+		zypper_snapshot_alias, url, zypper_snapshot_alias,
+	))
+}
+
+func (manager *zypper_manager) configure_repos(config Config) error {
+	if config.Local_repo == "none" {
+		return nil
+	}
+	gpgcheck := "--no-gpgcheck"
+	if config.Sign_key != "" {
+		gpgcheck = "--gpgcheck"
+		if err := manager.runner.run(fmt.Sprintf("gpg --export --armor %s | sudo rpm --import /dev/stdin", config.Sign_key)); err != nil {
+			return err
+		}
+	}
+	return manager.runner.run(fmt.Sprintf(
+		"sudo zypper --non-interactive addrepo --refresh %s dir:%s %s",
+		gpgcheck, filepath.Dir(config.Local_repo_path), local_repo_name(config),
+	))
+}
+
+func (manager *zypper_manager) local_repo_exists(config Config) bool {
+	_, err := os.Stat(filepath.Join(filepath.Dir(config.Local_repo_path), "repodata", "repomd.xml"))
+	return err == nil
+}
+
+func (manager *zypper_manager) init_local_repo(config Config) error {
+	os.MkdirAll(filepath.Dir(config.Local_repo_path), os.FileMode(0777))
+	return manager.update_local_repo(config)
+}
+
+func (manager *zypper_manager) add_to_local_repo(config Config, package_files []string) error {
+	local_repo_dir := filepath.Dir(config.Local_repo_path)
+	for _, package_file := range package_files {
+		err := manager.runner.modify("copy "+package_file+" to "+local_repo_dir, func() error {
+			return copyFile(package_file, filepath.Join(local_repo_dir, filepath.Base(package_file)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return manager.update_local_repo(config)
+}
+
+func (manager *zypper_manager) remove_from_local_repo(config Config, packages []string) error {
+	local_repo_dir := filepath.Dir(config.Local_repo_path)
+	for _, pkg := range packages {
+		files, _ := filepath.Glob(filepath.Join(local_repo_dir, pkg+"-*.rpm"))
+		for _, file := range files {
+			// the glob also matches packages whose name starts with pkg, e.g. pkg-devel
+			output, err := manager.runner.output("rpm -qp --qf '%{NAME}' " + file)
+			if err == nil && string(output) == pkg {
+				if err := manager.runner.run("rm " + file); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return manager.update_local_repo(config)
+}
+
+// regenerates the repository metadata and signs it if a key is configured
+func (manager *zypper_manager) update_local_repo(config Config) error {
+	local_repo_dir := filepath.Dir(config.Local_repo_path)
+	if err := manager.runner.run("createrepo_c --update " + local_repo_dir); err != nil {
+		return err
+	}
+	if config.Sign_key == "" {
+		return nil
+	}
+	repomd := filepath.Join(local_repo_dir, "repodata", "repomd.xml")
+	return manager.runner.run(fmt.Sprintf("gpg --batch --yes --detach-sign --armor --local-user %s %s", config.Sign_key, repomd))
+}
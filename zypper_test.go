@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestZypperQueryInstalled(t *testing.T) {
+	query := "rpm -q --qf '%{EPOCH}:%{VERSION}-%{RELEASE}' vim"
+	tests := []struct {
+		name   string
+		output map[string]string
+		want   string
+	}{
+		{"without epoch", map[string]string{query: "(none):9.1.0-1.1"}, "9.1.0-1.1"},
+		{"with epoch", map[string]string{query: "2:9.1.0-1.1"}, "2:9.1.0-1.1"},
+		{"not installed", nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &recording_runner{outputs: test.output}
+			manager := &zypper_manager{runner: runner}
+			if version := manager.query_installed("vim"); version != test.want {
+				t.Errorf("query_installed() = %q, want %q", version, test.want)
+			}
+			check_commands(t, runner, []string{query})
+		})
+	}
+}
+
+func TestZypperQueryExplicit(t *testing.T) {
+	auto_installed := filepath.Join(t.TempDir(), "AutoInstalled")
+	os.WriteFile(auto_installed, []byte("# Automatically installed packages\nlibfoo1\n"), 0644)
+	default_auto_installed := zypper_auto_installed
+	zypper_auto_installed = auto_installed
+	defer func() { zypper_auto_installed = default_auto_installed }()
+
+	query := "rpm -qa --qf '%{NAME}\\n'"
+	runner := &recording_runner{outputs: map[string]string{query: "vim\ngpg-pubkey\nlibfoo1\ngpg-pubkey\nzypper\nvim\n"}}
+	manager := &zypper_manager{runner: runner}
+
+	packages, err := manager.query_explicit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"vim", "zypper"}; !reflect.DeepEqual(packages, want) {
+		t.Errorf("query_explicit() = %q, want %q", packages, want)
+	}
+	check_commands(t, runner, []string{query})
+}
+
+func TestZypperCommands(t *testing.T) {
+	repo_dir := t.TempDir()
+	for _, file := range []string{"foo-1.0-1.x86_64.rpm", "foo-devel-1.0-1.x86_64.rpm"} {
+		os.WriteFile(filepath.Join(repo_dir, file), nil, 0644)
+	}
+	config := Config{
+		Local_repo:      "nomispaz",
+		Local_repo_path: filepath.Join(repo_dir, "nomispaz.db.tar.zst"),
+	}
+
+	tests := []struct {
+		name     string
+		sign_key string
+		outputs  map[string]string
+		action   func(manager *zypper_manager, config Config) error
+		want     []string
+	}{
+		{
+			name: "install",
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.install_local([]string{"a-1-1.x86_64.rpm"}, true)
+			},
+			want: []string{"sudo zypper --non-interactive install --allow-unsigned-rpm a-1-1.x86_64.rpm"},
+		},
+		{
+			name: "remove",
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.remove([]string{"vim", "emacs"})
+			},
+			want: []string{"sudo zypper --non-interactive remove --clean-deps vim emacs"},
+		},
+		{
+			name: "upgrade and install",
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.upgrade(config, []string{"vim"})
+			},
+			want: []string{
+				"sudo zypper --non-interactive refresh && sudo zypper dist-upgrade",
+				"sudo zypper --non-interactive install vim",
+			},
+		},
+		{
+			name: "snapshot",
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.set_snapshot(config, []string{"2024", "11", "20"})
+			},
+			want: []string{"sudo zypper --non-interactive removerepo nompac-snapshot >/dev/null 2>&1; " +
+				"sudo zypper --non-interactive addrepo --refresh https://download.opensuse.org/history/20241120/tumbleweed/repo/oss/ nompac-snapshot"},
+		},
+		{
+			name: "rolling",
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.set_snapshot(config, nil)
+			},
+			want: []string{"sudo zypper --non-interactive removerepo nompac-snapshot >/dev/null 2>&1 || true"},
+		},
+		{
+			name:     "configure signed local repository",
+			sign_key: "ABCDEF",
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.configure_repos(config)
+			},
+			want: []string{
+				"gpg --export --armor ABCDEF | sudo rpm --import /dev/stdin",
+				"sudo zypper --non-interactive addrepo --refresh --gpgcheck dir:" + repo_dir + " nomispaz",
+			},
+		},
+		{
+			name: "remove from local repository",
+			outputs: map[string]string{
+				"rpm -qp --qf '%{NAME}' " + filepath.Join(repo_dir, "foo-1.0-1.x86_64.rpm"):       "foo",
+				"rpm -qp --qf '%{NAME}' " + filepath.Join(repo_dir, "foo-devel-1.0-1.x86_64.rpm"): "foo-devel",
+			},
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.remove_from_local_repo(config, []string{"foo"})
+			},
+			want: []string{
+				"rpm -qp --qf '%{NAME}' " + filepath.Join(repo_dir, "foo-1.0-1.x86_64.rpm"),
+				"rm " + filepath.Join(repo_dir, "foo-1.0-1.x86_64.rpm"),
+				"rpm -qp --qf '%{NAME}' " + filepath.Join(repo_dir, "foo-devel-1.0-1.x86_64.rpm"),
+				"createrepo_c --update " + repo_dir,
+			},
+		},
+		{
+			name:     "update signed local repository",
+			sign_key: "ABCDEF",
+			action: func(manager *zypper_manager, config Config) error {
+				return manager.add_to_local_repo(config, []string{"/var/tmp/a-1-1.x86_64.rpm"})
+			},
+			want: []string{
+				"# copy /var/tmp/a-1-1.x86_64.rpm to " + repo_dir,
+				"createrepo_c --update " + repo_dir,
+				"gpg --batch --yes --detach-sign --armor --local-user ABCDEF " + filepath.Join(repo_dir, "repodata", "repomd.xml"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test_config := config
+			test_config.Sign_key = test.sign_key
+			runner := &recording_runner{outputs: test.outputs}
+			if err := test.action(&zypper_manager{runner: runner}, test_config); err != nil {
+				t.Fatal(err)
+			}
+			check_commands(t, runner, test.want)
+		})
+	}
+}